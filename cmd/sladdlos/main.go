@@ -1,10 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"github.com/satori/go.uuid"
 	"hemtjan.st/sladdlos"
+	"hemtjan.st/sladdlos/coap"
+	"hemtjan.st/sladdlos/replay"
+	"hemtjan.st/sladdlos/simulator"
 	"hemtjan.st/sladdlos/tradfri"
 	"hemtjan.st/sladdlos/transport"
 	"lib.hemtjan.st/client"
@@ -13,16 +19,45 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"syscall"
 	"time"
 )
 
+// coapRefresh is how often a tree fed over CoAP is resynced by default,
+// the gateway doesn't resend notifications that got lost
+const coapRefresh = time.Hour
+
 var (
 	cleanUpHemtjanst = flag.Bool("hemtjanst.cleanup", false, "Clean up Hemtjänst MQTT Topics")
 	cleanUpTradfri   = flag.Bool("tradfri.cleanup", false, "Clean up Trådfri MQTT Topics")
 	skipGroup        = flag.Bool("skip-group", false, "Skip announcing Trådfri groups as lights")
 	skipBulb         = flag.Bool("skip-bulb", false, "Skip announcing Trådfri bulbs individually")
+	skipScene        = flag.Bool("skip-scene", false, "Skip announcing the scenes of Trådfri groups as switches")
+	coapAddress      = flag.String("coap.address", "", "Address of the Trådfri gateway, talks CoAP directly instead of using tradfri-mqtt when set")
+	coapIdentity     = flag.String("coap.identity", "", "PSK identity registered with the Trådfri gateway")
+	coapPSK          = flag.String("coap.psk", "", "Pre-shared key belonging to -coap.identity")
+	retries          = flag.Int("tradfri.retries", 10, "Number of times to retry a command while tradfri-mqtt is offline, -1 retries forever")
+	backoff          = flag.Duration("tradfri.backoff", time.Second, "Initial delay between retries, doubled for every attempt")
+	maxBackoff       = flag.Duration("tradfri.max-backoff", time.Minute, "Maximum delay between retries")
+	statusTopic      = flag.String("tradfri.status-topic", "", "Topic where tradfri-mqtt publishes its online status, if any. {prefix} is replaced with the topic prefix")
+	recordFile       = flag.String("record.file", "sladdlos.jsonl", "File to write to in record mode")
+	recordAnonymize  = flag.Bool("record.anonymize", false, "Scrub names, serial numbers and gateway details from the recording")
+	replayFile       = flag.String("replay.file", "", "Replay a recording made with record mode instead of talking to a gateway")
+	replaySpeed      = flag.Float64("replay.speed", 1, "Speed to replay the recording at, 0 replays as fast as possible")
+	topicPrefix      = flag.String("tradfri.prefix", "tradfri", "Topic prefix of tradfri-mqtt (<prefix>-raw, <prefix>-cmd, <prefix>-reply), comma separated for multiple gateways")
+	cacheFile        = flag.String("cache.file", "sladdlos-cache.json", "File to keep a copy of the Trådfri tree in, to announce devices right away on startup. With multiple gateways the prefix is added to the name")
+	cacheDisable     = flag.Bool("cache.disable", false, "Don't load or save the Trådfri tree cache")
+	refreshInterval  = flag.Duration("tradfri.refresh", 0, "Interval to fully resync with the gateway, removing anything that's gone, 0 disables. Defaults to 1h with -coap.address as nothing else notices missed notifications")
+	occupancyTimeout = flag.Duration("motion.timeout", 3*time.Minute, "How long motion sensors report motion after the last sign of activity")
+	lowBattery       = flag.Int("battery.low", 15, "Battery level in percent below which a battery is reported as low")
+	batteryTopic     = flag.String("battery.topic", "sladdlos/battery", "Topic to publish the devices with a low battery to, the namespace is added with multiple gateways")
+	batteryInterval  = flag.Duration("battery.interval", time.Hour, "Interval to publish the devices with a low battery at, 0 disables")
+	inUsePower       = flag.Float64("plug.in-use", 2, "Power in watts above which an outlet that measures it is reported as in use")
+	transition       = flag.Duration("transition", 0, "How long lights fade when they're changed, 0 leaves it to the gateway")
+	transitionDevice = flag.String("transition.device", "", "Fade time per device as name=duration or topic=duration, comma separated, overriding -transition")
+	debug            = flag.Bool("debug", false, "Log every change to the Trådfri tree, including unknown fields")
 )
 
 func main() {
@@ -49,6 +84,11 @@ func main() {
 		return
 	}
 
+	transitions, err := parseTransitions(*transitionDevice)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	go func() {
 		quit := make(chan os.Signal)
 		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
@@ -57,44 +97,331 @@ func main() {
 		cancel()
 	}()
 
-	id := uuid.NewV4().String()
+	switch flag.Arg(0) {
+	case "simulate":
+		for _, prefix := range gatewayPrefixes() {
+			log.Printf("Simulating a gateway on %s-raw/#", prefix)
+			go simulator.NewDemo().Serve(ctx, mq, prefix)
+		}
+		<-ctx.Done()
+		return
+	case "record":
+		record(ctx, mq)
+		return
+	case "dump":
+		dump(ctx, mq, flag.Args()[1:])
+		return
+	}
 
-	tr := transport.NewTransport(mq, id)
-	tree := tradfri.NewTree(tr)
-	tr.SetTree(tree)
+	id := uuid.NewV4().String()
 
-	ht := sladdlos.NewHemtjanstClient(tree, mq, id)
+	var clients []*sladdlos.HemtjanstClient
+	gateways := newGateways(ctx, mq, id)
+	for _, gw := range gateways {
+		ht := sladdlos.NewHemtjanstClient(gw.tree, mq, id)
+		ht.Namespace = gw.namespace
+		clients = append(clients, ht)
+		if gw.cache {
+			useCache(ctx, gw.tree, gw.namespace)
+		}
+	}
 
-	ht.SkipGroup = *skipGroup
-	if ht.SkipGroup {
+	if *skipGroup {
 		log.Print("Skipping groups")
 	}
-	ht.SkipBulb = *skipBulb
-	if ht.SkipBulb {
+	if *skipBulb {
 		log.Print("Skipping bulbs")
 	}
+	for _, ht := range clients {
+		ht.SkipGroup = *skipGroup
+		ht.SkipBulb = *skipBulb
+		ht.SkipScene = *skipScene
+		ht.OccupancyTimeout = *occupancyTimeout
+		ht.LowBattery = *lowBattery
+		ht.InUsePower = *inUsePower
+		ht.Transition = *transition
+		ht.Transitions = transitions
+	}
+
+	if *debug {
+		for _, gw := range gateways {
+			go logEvents(ctx, gw)
+		}
+	}
+
+	for _, gw := range gateways {
+		if err := gw.start(); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	ht.Start(ctx)
+	for _, ht := range clients {
+		go ht.Start(ctx)
+		if *batteryInterval > 0 && *batteryTopic != "" {
+			topic := *batteryTopic
+			if ht.Namespace != "" {
+				topic += "/" + ht.Namespace
+			}
+			go ht.ReportBatteries(ctx, topic, *batteryInterval)
+		}
+	}
+
+	for _, gw := range gateways {
+		if gw.refresh > 0 {
+			go gw.tree.RefreshEvery(ctx, gw.refresh)
+		}
+	}
 
 	<-ctx.Done()
 }
 
-func clean(tr mqtt.MQTT, ctx context.Context, cancel func()) {
-	time.AfterFunc(10*time.Second, cancel)
+// gateway is the tree of one Trådfri gateway and how to start feeding it
+type gateway struct {
+	namespace string
+	tree      *tradfri.Tree
+	// cache is false if the tree shouldn't be cached, i.e. when replaying
+	cache bool
+	// refresh is the interval to resync the tree at, 0 disables
+	refresh time.Duration
+	start   func() error
+}
 
-	if *cleanUpTradfri {
-		rawch := tr.SubscribeRaw("tradfri-raw/#")
+func newGateways(ctx context.Context, mq mqtt.MQTT, id string) []*gateway {
+	var gateways []*gateway
 
-		for {
-			m, open := <-rawch
-			if !open {
-				return
+	if *coapAddress != "" {
+		tr := coap.NewTransport(*coapAddress, *coapIdentity, *coapPSK)
+		tree := tradfri.NewTree(tr)
+		tr.SetTree(tree)
+		gateways = append(gateways, &gateway{
+			tree:    tree,
+			cache:   true,
+			refresh: refreshFor(coapRefresh),
+			start:   func() error { return tr.Start(ctx) },
+		})
+		return gateways
+	}
+
+	prefixes := gatewayPrefixes()
+	namespace := func(prefix string) string {
+		if len(prefixes) > 1 {
+			return prefix
+		}
+		return ""
+	}
+
+	if *replayFile != "" {
+		for _, prefix := range prefixes {
+			f, err := os.Open(*replayFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			// Captures name the gateway by its prefix, even with just one
+			tr, err := replay.Load(f, prefix)
+			_ = f.Close()
+			if err != nil {
+				log.Fatal(err)
 			}
-			if m.IsRetain {
-				log.Printf("Deleting contents of topic %s", m.TopicName)
-				tr.Publish(m.TopicName, []byte{}, true)
+			tr.Speed = *replaySpeed
+			tree := tradfri.NewTree(tr)
+			tr.SetTree(tree)
+			gateways = append(gateways, &gateway{
+				namespace: namespace(prefix),
+				tree:      tree,
+				refresh:   *refreshInterval,
+				start:     func() error { return tr.Start(ctx) },
+			})
+		}
+		return gateways
+	}
+
+	for _, prefix := range prefixes {
+		tr := transport.NewTransport(mq, id)
+		tr.SetPrefix(prefix)
+		tr.Retries = *retries
+		tr.Backoff = *backoff
+		tr.MaxBackoff = *maxBackoff
+		tr.StatusTopic = strings.Replace(*statusTopic, "{prefix}", prefix, -1)
+		tree := tradfri.NewTree(tr)
+		gateways = append(gateways, &gateway{
+			namespace: namespace(prefix),
+			tree:      tree,
+			cache:     true,
+			refresh:   *refreshInterval,
+			start: func() error {
+				tr.SetTree(tree)
+				return nil
+			},
+		})
+	}
+	return gateways
+}
+
+// refreshFor returns -tradfri.refresh if it's set, or def otherwise
+func refreshFor(def time.Duration) time.Duration {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "tradfri.refresh" {
+			set = true
+		}
+	})
+	if set {
+		return *refreshInterval
+	}
+	return def
+}
+
+// useCache loads the tree from the cache, must be done before the
+// transport starts so that it doesn't overwrite live data
+func useCache(ctx context.Context, tree *tradfri.Tree, namespace string) {
+	if *cacheDisable || *cacheFile == "" {
+		return
+	}
+	name := *cacheFile
+	if namespace != "" {
+		ext := filepath.Ext(name)
+		name = strings.TrimSuffix(name, ext) + "-" + namespace + ext
+	}
+	if err := tree.LoadFile(name); err != nil {
+		log.Printf("Error loading cache from %s: %v", name, err)
+	}
+	go tree.SaveOnChange(ctx, name, 5*time.Second)
+}
+
+// logEvents logs everything that happens in the tree
+func logEvents(ctx context.Context, gw *gateway) {
+	for e := range gw.tree.Subscribe(ctx, nil) {
+		prefix := e.URI
+		if gw.namespace != "" {
+			prefix = gw.namespace + " " + prefix
+		}
+		if len(e.Changes) == 0 {
+			log.Printf("[%s] %s %s", prefix, e.Kind, e.Type)
+			continue
+		}
+		for _, ch := range e.Changes {
+			log.Printf("[%s] %s %s %s", prefix, e.Kind, e.Type, ch)
+		}
+	}
+}
+
+// dump fetches everything from every gateway and prints it the way the
+// gateway sent it, for figuring out what the unknown codes are
+func dump(ctx context.Context, mq mqtt.MQTT, args []string) {
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	annotate := flags.Bool("annotate", false, "Add the name of every known IPSO code to the keys")
+	_ = flags.Parse(args)
+
+	gateways := newGateways(ctx, mq, uuid.NewV4().String())
+	out := map[string]json.RawMessage{}
+	for _, gw := range gateways {
+		if err := gw.start(); err != nil {
+			log.Fatal(err)
+		}
+		rctx, cancel := context.WithTimeout(ctx, time.Minute)
+		err := gw.tree.Refresh(rctx)
+		cancel()
+		if err != nil {
+			log.Fatalf("Error fetching tree from gateway: %v", err)
+		}
+		buf := &bytes.Buffer{}
+		if err := gw.tree.Save(buf); err != nil {
+			log.Fatal(err)
+		}
+		data := buf.Bytes()
+		if *annotate {
+			if data, err = tradfri.Annotate(data); err != nil {
+				log.Fatal(err)
 			}
+		}
+		out[gw.namespace] = data
+	}
+
+	var v interface{} = out
+	if len(gateways) == 1 {
+		v = out[gateways[0].namespace]
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Fatal(err)
+	}
+}
 
+func record(ctx context.Context, mq mqtt.MQTT) {
+	f, err := os.Create(*recordFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	rec := replay.NewRecorder(f)
+	rec.Anonymize = *recordAnonymize
+	log.Printf("Recording to %s", *recordFile)
+
+	errCh := make(chan error)
+	prefixes := gatewayPrefixes()
+	for _, prefix := range prefixes {
+		go func(prefix string) {
+			errCh <- rec.Record(ctx, mq, prefix)
+		}(prefix)
+	}
+	for range prefixes {
+		if err := <-errCh; err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// parseTransitions parses -transition.device, i.e. "Kitchen=2s,Hallway=500ms"
+func parseTransitions(s string) (map[string]time.Duration, error) {
+	transitions := map[string]time.Duration{}
+	if s == "" {
+		return transitions, nil
+	}
+	for _, kv := range strings.Split(s, ",") {
+		i := strings.LastIndex(kv, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("-transition.device: expected name=duration, got %q", kv)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(kv[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("-transition.device: %v", err)
+		}
+		transitions[strings.TrimSpace(kv[:i])] = d
+	}
+	return transitions, nil
+}
+
+func gatewayPrefixes() []string {
+	var prefixes []string
+	for _, p := range strings.Split(*topicPrefix, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			prefixes = append(prefixes, p)
+		}
+	}
+	return prefixes
+}
+
+func clean(tr mqtt.MQTT, ctx context.Context, cancel func()) {
+	time.AfterFunc(10*time.Second, cancel)
+
+	if *cleanUpTradfri {
+		for _, prefix := range gatewayPrefixes() {
+			rawch := tr.SubscribeRaw(prefix + "-raw/#")
+
+			go func() {
+				for {
+					m, open := <-rawch
+					if !open {
+						return
+					}
+					if m.IsRetain {
+						log.Printf("Deleting contents of topic %s", m.TopicName)
+						tr.Publish(m.TopicName, []byte{}, true)
+					}
+				}
+			}()
 		}
 	}
 
@@ -113,7 +440,9 @@ func clean(tr mqtt.MQTT, ctx context.Context, cancel func()) {
 					continue
 				}
 				sp := strings.Split(ev.Device.Id(), "/")
-				if len(sp) == 2 && (strings.Index(sp[1], "grp-") == 0 || strings.Index(sp[1], "bulb-") == 0) {
+				last := sp[len(sp)-1]
+				if len(sp) >= 2 && (strings.Index(last, "grp-") == 0 || strings.Index(last, "bulb-") == 0 || strings.Index(last, "scene-") == 0 ||
+					strings.Index(last, "motion-") == 0 || strings.Index(last, "remote-") == 0) {
 					log.Printf("Deleting device %s", ev.Device.Id())
 					_ = client.DeleteDevice(ev.Device.Info(), tr)
 				}
@@ -123,4 +452,5 @@ func clean(tr mqtt.MQTT, ctx context.Context, cancel func()) {
 		_ = srv.Start(ctx)
 	}
 
+	<-ctx.Done()
 }
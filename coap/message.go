@@ -0,0 +1,219 @@
+package coap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type msgType uint8
+
+const (
+	typeConfirmable    msgType = 0
+	typeNonConfirmable msgType = 1
+	typeAck            msgType = 2
+	typeReset          msgType = 3
+)
+
+type code uint8
+
+const (
+	codeEmpty  code = 0x00
+	codeGet    code = 0x01
+	codePost   code = 0x02
+	codePut    code = 0x03
+	codeDelete code = 0x04
+)
+
+func (c code) class() uint8 {
+	return uint8(c >> 5)
+}
+
+func (c code) String() string {
+	switch c {
+	case codeGet:
+		return "GET"
+	case codePost:
+		return "POST"
+	case codePut:
+		return "PUT"
+	case codeDelete:
+		return "DELETE"
+	}
+	return fmt.Sprintf("%d.%02d", c>>5, c&0x1f)
+}
+
+const (
+	optObserve uint16 = 6
+	optURIPath uint16 = 11
+	optBlock2  uint16 = 23
+)
+
+const payloadMarker = 0xff
+
+var (
+	errShortMessage  = errors.New("coap: message too short")
+	errInvalidHeader = errors.New("coap: invalid header")
+	errInvalidOption = errors.New("coap: invalid option")
+)
+
+type option struct {
+	num   uint16
+	value []byte
+}
+
+type message struct {
+	typ     msgType
+	code    code
+	id      uint16
+	token   []byte
+	options []option
+	payload []byte
+}
+
+func (m *message) addOption(num uint16, value []byte) {
+	m.options = append(m.options, option{num: num, value: value})
+}
+
+func (m *message) addUintOption(num uint16, v uint32) {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	for len(b) > 0 && b[0] == 0 {
+		b = b[1:]
+	}
+	m.addOption(num, b)
+}
+
+func (m *message) setPath(uri string) {
+	for _, p := range strings.Split(strings.Trim(uri, "/"), "/") {
+		m.addOption(optURIPath, []byte(p))
+	}
+}
+
+func (m *message) path() string {
+	var p []string
+	for _, o := range m.options {
+		if o.num == optURIPath {
+			p = append(p, string(o.value))
+		}
+	}
+	return strings.Join(p, "/")
+}
+
+func (m *message) uintOption(num uint16) (uint32, bool) {
+	for _, o := range m.options {
+		if o.num != num {
+			continue
+		}
+		var v uint32
+		for _, b := range o.value {
+			v = v<<8 | uint32(b)
+		}
+		return v, true
+	}
+	return 0, false
+}
+
+func (m *message) MarshalBinary() ([]byte, error) {
+	if len(m.token) > 8 {
+		return nil, errInvalidHeader
+	}
+	b := []byte{1<<6 | byte(m.typ)<<4 | byte(len(m.token)), byte(m.code), byte(m.id >> 8), byte(m.id)}
+	b = append(b, m.token...)
+
+	sort.SliceStable(m.options, func(i, j int) bool {
+		return m.options[i].num < m.options[j].num
+	})
+	var prev uint16
+	for _, o := range m.options {
+		delta, deltaExt := optNibble(int(o.num - prev))
+		length, lengthExt := optNibble(len(o.value))
+		b = append(b, delta<<4|length)
+		b = append(b, deltaExt...)
+		b = append(b, lengthExt...)
+		b = append(b, o.value...)
+		prev = o.num
+	}
+	if len(m.payload) > 0 {
+		b = append(b, payloadMarker)
+		b = append(b, m.payload...)
+	}
+	return b, nil
+}
+
+func (m *message) UnmarshalBinary(data []byte) error {
+	if len(data) < 4 {
+		return errShortMessage
+	}
+	if data[0]>>6 != 1 {
+		return errInvalidHeader
+	}
+	tkl := int(data[0] & 0x0f)
+	if tkl > 8 || len(data) < 4+tkl {
+		return errInvalidHeader
+	}
+	m.typ = msgType(data[0] >> 4 & 0x03)
+	m.code = code(data[1])
+	m.id = binary.BigEndian.Uint16(data[2:4])
+	m.token = append([]byte{}, data[4:4+tkl]...)
+	m.options = nil
+	m.payload = nil
+
+	b := data[4+tkl:]
+	num := 0
+	for len(b) > 0 {
+		if b[0] == payloadMarker {
+			m.payload = append([]byte{}, b[1:]...)
+			break
+		}
+		delta := int(b[0] >> 4)
+		length := int(b[0] & 0x0f)
+		b = b[1:]
+		var err error
+		if delta, b, err = optExtended(delta, b); err != nil {
+			return err
+		}
+		if length, b, err = optExtended(length, b); err != nil {
+			return err
+		}
+		if len(b) < length {
+			return errInvalidOption
+		}
+		num += delta
+		m.options = append(m.options, option{num: uint16(num), value: append([]byte{}, b[:length]...)})
+		b = b[length:]
+	}
+	return nil
+}
+
+func optNibble(v int) (byte, []byte) {
+	switch {
+	case v < 13:
+		return byte(v), nil
+	case v < 269:
+		return 13, []byte{byte(v - 13)}
+	default:
+		v -= 269
+		return 14, []byte{byte(v >> 8), byte(v)}
+	}
+}
+
+func optExtended(v int, b []byte) (int, []byte, error) {
+	switch v {
+	case 13:
+		if len(b) < 1 {
+			return 0, nil, errInvalidOption
+		}
+		return int(b[0]) + 13, b[1:], nil
+	case 14:
+		if len(b) < 2 {
+			return 0, nil, errInvalidOption
+		}
+		return int(binary.BigEndian.Uint16(b)) + 269, b[2:], nil
+	case 15:
+		return 0, nil, errInvalidOption
+	}
+	return v, b, nil
+}
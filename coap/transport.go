@@ -0,0 +1,462 @@
+package coap
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/pion/dtls"
+	"hemtjan.st/sladdlos/tradfri"
+	"log"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPort    = "5684"
+	requestTimeout = 10 * time.Second
+	ackTimeout     = 2 * time.Second
+	maxRetransmit  = 4
+	maxMessageSize = 4096
+)
+
+var errNotConnected = errors.New("coap: not connected to gateway")
+
+// Transport talks CoAP over DTLS directly to the Trådfri gateway, using a
+// PSK identity and key previously registered with the gateway.
+type Transport struct {
+	sync.RWMutex
+	addr         string
+	identity     string
+	psk          []byte
+	conn         net.Conn
+	tree         *tradfri.Tree
+	msgID        uint16
+	token        uint32
+	waiting      map[string]*pending
+	observing    map[string]*observation
+	observations []*observation
+}
+
+type observation struct {
+	uri      string
+	callback func(data []byte)
+}
+
+type pending struct {
+	id    uint16
+	acked bool
+	resp  chan *message
+	ack   chan struct{}
+}
+
+func NewTransport(addr, identity, psk string) *Transport {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, defaultPort)
+	}
+	return &Transport{
+		addr:      addr,
+		identity:  identity,
+		psk:       []byte(psk),
+		msgID:     uint16(rand.Uint32()),
+		token:     rand.Uint32(),
+		waiting:   map[string]*pending{},
+		observing: map[string]*observation{},
+	}
+}
+
+func (t *Transport) SetTree(tree *tradfri.Tree) {
+	t.Lock()
+	defer t.Unlock()
+	t.tree = tree
+}
+
+// Start connects to the gateway and populates the tree, which is then kept
+// up to date by observing until the context is cancelled.
+func (t *Transport) Start(ctx context.Context) error {
+	conn, err := t.dial()
+	if err != nil {
+		return err
+	}
+	t.Lock()
+	t.conn = conn
+	observations := t.observations
+	t.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		t.Lock()
+		defer t.Unlock()
+		if t.conn != nil {
+			_ = t.conn.Close()
+			t.conn = nil
+		}
+	}()
+	go t.readLoop(ctx, conn)
+	if len(observations) > 0 {
+		// Observed before being connected, i.e. when loading a cached tree
+		go t.reobserve(ctx, observations)
+	}
+	go t.refresh(ctx)
+	return nil
+}
+
+func (t *Transport) dial() (net.Conn, error) {
+	addr, err := net.ResolveUDPAddr("udp", t.addr)
+	if err != nil {
+		return nil, err
+	}
+	return dtls.Dial("udp", addr, &dtls.Config{
+		PSK: func(hint []byte) ([]byte, error) {
+			return t.psk, nil
+		},
+		PSKIdentityHint: []byte(t.identity),
+		CipherSuites:    []dtls.CipherSuiteID{dtls.TLS_PSK_WITH_AES_128_CCM_8},
+	})
+}
+
+func (t *Transport) readLoop(ctx context.Context, conn net.Conn) {
+	backoff := time.Second
+	for {
+		buf := make([]byte, maxMessageSize)
+		n, err := conn.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Error reading from gateway: %v", err)
+			_ = conn.Close()
+			t.Lock()
+			t.conn = nil
+			t.Unlock()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(backoff):
+				}
+				if conn, err = t.dial(); err == nil {
+					break
+				}
+				log.Printf("Error reconnecting to gateway: %v", err)
+				if backoff < time.Minute {
+					backoff *= 2
+				}
+			}
+			backoff = time.Second
+			t.Lock()
+			if ctx.Err() != nil {
+				t.Unlock()
+				_ = conn.Close()
+				return
+			}
+			t.conn = conn
+			t.observing = map[string]*observation{}
+			observations := t.observations
+			t.Unlock()
+			go t.reobserve(ctx, observations)
+			continue
+		}
+		msg := &message{}
+		if err := msg.UnmarshalBinary(buf[:n]); err != nil {
+			log.Printf("Error parsing message from gateway: %v", err)
+			continue
+		}
+		t.onMessage(msg)
+	}
+}
+
+func (t *Transport) onMessage(msg *message) {
+	if msg.typ == typeConfirmable && msg.code != codeEmpty {
+		_ = t.send(&message{typ: typeAck, code: codeEmpty, id: msg.id})
+	}
+	if msg.code == codeEmpty {
+		if msg.typ == typeAck {
+			t.Lock()
+			defer t.Unlock()
+			for _, p := range t.waiting {
+				if p.id == msg.id && !p.acked {
+					p.acked = true
+					close(p.ack)
+				}
+			}
+		}
+		return
+	}
+
+	t.RLock()
+	p, ok := t.waiting[string(msg.token)]
+	o, observed := t.observing[string(msg.token)]
+	t.RUnlock()
+	if ok {
+		select {
+		case p.resp <- msg:
+		default:
+		}
+		return
+	}
+	if observed {
+		t.notify(msg, o)
+		return
+	}
+	if msg.typ == typeConfirmable || msg.typ == typeNonConfirmable {
+		// Not interested (anymore), tell the gateway to stop sending
+		_ = t.send(&message{typ: typeReset, code: codeEmpty, id: msg.id})
+	}
+}
+
+func (t *Transport) send(msg *message) error {
+	b, err := msg.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	t.RLock()
+	conn := t.conn
+	t.RUnlock()
+	if conn == nil {
+		return errNotConnected
+	}
+	_, err = conn.Write(b)
+	return err
+}
+
+func (t *Transport) newRequest(c code, uri string, payload []byte) *message {
+	t.Lock()
+	defer t.Unlock()
+	t.msgID++
+	t.token++
+	msg := &message{
+		typ:     typeConfirmable,
+		code:    c,
+		id:      t.msgID,
+		token:   make([]byte, 4),
+		payload: payload,
+	}
+	binary.BigEndian.PutUint32(msg.token, t.token)
+	msg.setPath(uri)
+	return msg
+}
+
+func (t *Transport) exchange(ctx context.Context, req *message) (*message, error) {
+	p := &pending{
+		id:   req.id,
+		resp: make(chan *message, 1),
+		ack:  make(chan struct{}),
+	}
+	key := string(req.token)
+	t.Lock()
+	t.waiting[key] = p
+	t.Unlock()
+	defer func() {
+		t.Lock()
+		defer t.Unlock()
+		delete(t.waiting, key)
+	}()
+
+	timeout := ackTimeout
+	for attempt := 0; ; attempt++ {
+		if err := t.send(req); err != nil {
+			return nil, err
+		}
+		retransmit := time.NewTimer(timeout)
+		select {
+		case resp := <-p.resp:
+			retransmit.Stop()
+			return resp, nil
+		case <-p.ack:
+			// Separate response, stop retransmitting and wait for it
+			retransmit.Stop()
+			select {
+			case resp := <-p.resp:
+				return resp, nil
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		case <-retransmit.C:
+			if attempt >= maxRetransmit {
+				return nil, fmt.Errorf("coap: no response to %s %s", req.code, req.path())
+			}
+			timeout *= 2
+		case <-ctx.Done():
+			retransmit.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (t *Transport) request(ctx context.Context, c code, uri string, payload []byte) ([]byte, error) {
+	var body []byte
+	var block uint32
+	for {
+		req := t.newRequest(c, uri, payload)
+		if block > 0 {
+			req.addUintOption(optBlock2, block)
+		}
+		resp, err := t.exchange(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		if err := tradfri.ErrorFromCode(resp.code.String()); err != nil {
+			return nil, err
+		}
+		body = append(body, resp.payload...)
+
+		b2, ok := resp.uintOption(optBlock2)
+		if !ok || b2&0x08 == 0 {
+			return body, nil
+		}
+		// Ask for the next block using the size the gateway picked
+		block = (b2>>4+1)<<4 | b2&0x07
+	}
+}
+
+func (t *Transport) Get(uri string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	return t.GetContext(ctx, uri)
+}
+
+func (t *Transport) Put(uri string, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	return t.PutContext(ctx, uri, data)
+}
+
+func (t *Transport) Delete(uri string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	return t.DeleteContext(ctx, uri)
+}
+
+func (t *Transport) GetContext(ctx context.Context, uri string) ([]byte, error) {
+	return t.request(ctx, codeGet, uri, nil)
+}
+
+func (t *Transport) PutContext(ctx context.Context, uri string, data []byte) error {
+	_, err := t.request(ctx, codePut, uri, data)
+	return err
+}
+
+func (t *Transport) DeleteContext(ctx context.Context, uri string) error {
+	_, err := t.request(ctx, codeDelete, uri, nil)
+	return err
+}
+
+// Observe registers a CoAP observation of uri with the gateway, callback is
+// invoked with the current state and then with every notification.
+func (t *Transport) Observe(method, uri string, callback func(data []byte)) (func(), error) {
+	if method != "" && strings.ToLower(method) != "get" {
+		return nil, fmt.Errorf("coap: can't observe using method %s", method)
+	}
+	o := &observation{uri: uri, callback: callback}
+	t.Lock()
+	t.observations = append(t.observations, o)
+	connected := t.conn != nil
+	t.Unlock()
+	cancel := func() {
+		t.forget(o)
+	}
+	if !connected {
+		// Observed once connected
+		return cancel, nil
+	}
+
+	ctx, done := context.WithTimeout(context.Background(), requestTimeout)
+	defer done()
+	if err := t.observe(ctx, o); err != nil {
+		t.forget(o)
+		return nil, err
+	}
+	return cancel, nil
+}
+
+// forget stops passing notifications to o, the gateway is told to stop
+// sending them when the next one arrives
+func (t *Transport) forget(o *observation) {
+	t.Lock()
+	defer t.Unlock()
+	for key, obs := range t.observing {
+		if obs == o {
+			delete(t.observing, key)
+		}
+	}
+	for i, obs := range t.observations {
+		if obs == o {
+			t.observations = append(t.observations[:i:i], t.observations[i+1:]...)
+			break
+		}
+	}
+}
+
+func (t *Transport) observe(ctx context.Context, o *observation) error {
+	req := t.newRequest(codeGet, o.uri, nil)
+	req.addUintOption(optObserve, 0)
+	key := string(req.token)
+	t.Lock()
+	t.observing[key] = o
+	t.Unlock()
+
+	resp, err := t.exchange(ctx, req)
+	if err == nil {
+		err = tradfri.ErrorFromCode(resp.code.String())
+	}
+	if err != nil {
+		t.Lock()
+		delete(t.observing, key)
+		t.Unlock()
+		return err
+	}
+	t.notify(resp, o)
+	return nil
+}
+
+func (t *Transport) reobserve(ctx context.Context, observations []*observation) {
+	for _, o := range observations {
+		rctx, cancel := context.WithTimeout(ctx, requestTimeout)
+		if err := t.observe(rctx, o); err != nil {
+			log.Printf("Error observing %s: %v", o.uri, err)
+		}
+		cancel()
+	}
+}
+
+func (t *Transport) notify(msg *message, o *observation) {
+	if err := tradfri.ErrorFromCode(msg.code.String()); err != nil {
+		log.Printf("Observation of %s ended with %s", o.uri, msg.code)
+		t.forget(o)
+		if tradfri.Cause(err) == tradfri.ErrNotFound {
+			// Resource was removed
+			o.callback([]byte{})
+		}
+		return
+	}
+	if b2, ok := msg.uintOption(optBlock2); ok && b2&0x08 != 0 {
+		// Notification didn't fit in one message, fetch all of it
+		go func() {
+			data, err := t.Get(o.uri)
+			if err != nil {
+				log.Printf("Error fetching %s: %v", o.uri, err)
+				return
+			}
+			o.callback(data)
+		}()
+		return
+	}
+	o.callback(msg.payload)
+}
+
+// refresh fetches the whole tree from the gateway once connected
+func (t *Transport) refresh(ctx context.Context) {
+	t.RLock()
+	tree := t.tree
+	t.RUnlock()
+	if tree == nil {
+		return
+	}
+	if err := tree.Refresh(ctx); err != nil && ctx.Err() == nil {
+		log.Printf("Error fetching tree from gateway: %v", err)
+	}
+}
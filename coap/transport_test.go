@@ -0,0 +1,186 @@
+package coap
+
+import (
+	"context"
+	"github.com/pion/dtls"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	codeChanged code = 0x44
+	codeContent code = 0x45
+	codeMissing code = 0x84
+)
+
+// standIn is a DTLS-PSK CoAP server that serves a few resources, answers
+// GET and PUT and notifies observers of every PUT, like the gateway does
+type standIn struct {
+	sync.Mutex
+	listener  *dtls.Listener
+	resources map[string][]byte
+	observers map[string][][]byte
+	conn      net.Conn
+	seq       uint32
+	id        uint16
+}
+
+func newStandIn(t *testing.T, identity, psk string) *standIn {
+	l, err := dtls.Listen("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, &dtls.Config{
+		PSK: func(hint []byte) ([]byte, error) {
+			if string(hint) != identity {
+				t.Errorf("Got identity %q, expected %q", hint, identity)
+			}
+			return []byte(psk), nil
+		},
+		PSKIdentityHint: []byte("gateway"),
+		CipherSuites:    []dtls.CipherSuiteID{dtls.TLS_PSK_WITH_AES_128_CCM_8},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &standIn{
+		listener: l,
+		resources: map[string][]byte{
+			"15001/65536": []byte(`{"9001":"Kitchen","3311":[{"5850":0}]}`),
+		},
+		observers: map[string][][]byte{},
+	}
+	go s.serve()
+	return s
+}
+
+func (s *standIn) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *standIn) close() {
+	_ = s.listener.Close(time.Second)
+	s.Lock()
+	defer s.Unlock()
+	if s.conn != nil {
+		_ = s.conn.Close()
+	}
+}
+
+func (s *standIn) serve() {
+	conn, err := s.listener.Accept()
+	if err != nil {
+		return
+	}
+	s.Lock()
+	s.conn = conn
+	s.Unlock()
+	for {
+		buf := make([]byte, maxMessageSize)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		req := &message{}
+		if err := req.UnmarshalBinary(buf[:n]); err != nil || req.typ != typeConfirmable {
+			continue
+		}
+		s.handle(conn, req)
+	}
+}
+
+func (s *standIn) handle(conn net.Conn, req *message) {
+	s.Lock()
+	defer s.Unlock()
+	uri := req.path()
+	resp := &message{typ: typeAck, id: req.id, token: req.token}
+	data, ok := s.resources[uri]
+	switch {
+	case !ok:
+		resp.code = codeMissing
+	case req.code == codeGet:
+		resp.code = codeContent
+		resp.payload = data
+		if _, observe := req.uintOption(optObserve); observe {
+			s.observers[uri] = append(s.observers[uri], req.token)
+			resp.addUintOption(optObserve, s.seq)
+		}
+	case req.code == codePut:
+		s.resources[uri] = req.payload
+		resp.code = codeChanged
+	}
+	s.write(conn, resp)
+	if resp.code != codeChanged {
+		return
+	}
+	for _, token := range s.observers[uri] {
+		s.seq++
+		s.id++
+		notification := &message{typ: typeNonConfirmable, code: codeContent, id: s.id, token: token, payload: req.payload}
+		notification.addUintOption(optObserve, s.seq)
+		s.write(conn, notification)
+	}
+}
+
+func (s *standIn) write(conn net.Conn, msg *message) {
+	b, err := msg.MarshalBinary()
+	if err != nil {
+		return
+	}
+	_, _ = conn.Write(b)
+}
+
+func TestTransport(t *testing.T) {
+	s := newStandIn(t, "sladdlos", "secret")
+	defer s.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tr := NewTransport(s.addr(), "sladdlos", "secret")
+	if err := tr.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := tr.GetContext(ctx, "15001/65536")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"9001":"Kitchen","3311":[{"5850":0}]}` {
+		t.Errorf("Get returned %s", data)
+	}
+	if _, err := tr.GetContext(ctx, "15001/1"); err == nil {
+		t.Error("Get of a missing resource succeeded")
+	}
+
+	notifications := make(chan string, 2)
+	stop, err := tr.Observe("get", "15001/65536", func(data []byte) {
+		notifications <- string(data)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := <-notifications; got != string(data) {
+		t.Errorf("Observe started with %s", got)
+	}
+
+	on := `{"3311":[{"5850":1}]}`
+	if err := tr.PutContext(ctx, "15001/65536", []byte(on)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-notifications:
+		if got != on {
+			t.Errorf("Observe notified %s, expected %s", got, on)
+		}
+	case <-ctx.Done():
+		t.Fatal("No notification after Put")
+	}
+
+	stop()
+	if err := tr.PutContext(ctx, "15001/65536", []byte(`{"3311":[{"5850":0}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-notifications:
+		t.Errorf("Observe notified %s after being cancelled", got)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
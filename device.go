@@ -27,15 +27,23 @@ type HemtjanstDevice struct {
 	client         *HemtjanstClient
 	Topic          string
 	isRunning      bool
+	isRemoved      bool
 	isGroup        bool
 	accessory      *tradfri.Accessory
 	members        []*HemtjanstDevice
 	group          *tradfri.Group
 	device         client.Device
+	info           *device.Info
+	unobserve      func()
 	features       map[string]client.Feature
 	lastHue        *int
 	lastSaturation *int
 	blind          *blindInfo
+	motion         *motionInfo
+	// transition is the fade requested from Hemtjänst, if any. It has a
+	// lock of its own as it's read while the device is locked.
+	transition     *time.Duration
+	transitionLock sync.RWMutex
 }
 type blindInfo struct {
 	sync.RWMutex
@@ -46,22 +54,42 @@ type blindInfo struct {
 }
 type blindDirection int
 
+// fader is a light or group that can fade to its next state
+type fader interface {
+	SetTransitionTime(d time.Duration)
+}
+
+type motionInfo struct {
+	sync.RWMutex
+	detected bool
+	timer    *time.Timer
+	// groupOn is when a group of the sensor was last turned on by someone
+	// else than us
+	groupOn time.Time
+}
+
+// ownChangeWindow is how long after sending changes of a group an on
+// change of it is taken to be caused by them rather than by a sensor
+const ownChangeWindow = 5 * time.Second
+
+// motionWindow is how close to a group turning on a motion sensor has to
+// be seen for that to count as motion
+const motionWindow = 10 * time.Second
+
 const (
 	blindClosing blindDirection = 0
 	blindOpening blindDirection = 1
 	blindStopped blindDirection = 2
 )
 
-func NewHemtjanstAccessory(client *HemtjanstClient, topic string, accessory *tradfri.Accessory, group *HemtjanstDevice) *HemtjanstDevice {
+func NewHemtjanstAccessory(client *HemtjanstClient, topic string, accessory *tradfri.Accessory, groups ...*HemtjanstDevice) *HemtjanstDevice {
 	h := &HemtjanstDevice{
 		Topic:     topic,
 		client:    client,
 		isRunning: false,
 		isGroup:   false,
 		accessory: accessory,
-	}
-	if group != nil {
-		h.members = []*HemtjanstDevice{group}
+		members:   append([]*HemtjanstDevice{}, groups...),
 	}
 	h.init()
 	return h
@@ -80,8 +108,10 @@ func NewHemtjanstGroup(client *HemtjanstClient, topic string, group *tradfri.Gro
 }
 
 func (h *HemtjanstDevice) shouldSkip() bool {
+	// Bulbs that aren't in a group are announced regardless, as they'd
+	// otherwise not be reachable at all
 	return h.isGroup && h.client.SkipGroup ||
-		!h.isGroup && h.accessory.IsLight() && h.client.SkipBulb
+		!h.isGroup && h.accessory.IsLight() && h.client.SkipBulb && len(h.members) > 0
 }
 
 func (h *HemtjanstDevice) AddMember(member *HemtjanstDevice) {
@@ -94,22 +124,103 @@ func (h *HemtjanstDevice) AddMember(member *HemtjanstDevice) {
 	h.init()
 }
 
-func (h *HemtjanstDevice) init() {
-	if h.isRunning {
+// RemoveMember removes an accessory from a group, or a group from
+// an accessory
+func (h *HemtjanstDevice) RemoveMember(member *HemtjanstDevice) {
+	h.Lock()
+	defer h.Unlock()
+	for i, m := range h.members {
+		if m == member {
+			h.members = append(h.members[:i:i], h.members[i+1:]...)
+			return
+		}
+	}
+}
+
+// Members returns a copy of the current members
+func (h *HemtjanstDevice) Members() []*HemtjanstDevice {
+	h.RLock()
+	defer h.RUnlock()
+	return append([]*HemtjanstDevice{}, h.members...)
+}
+
+// Remove deletes the device from Hemtjänst and stops reacting to changes
+// of the Trådfri device
+func (h *HemtjanstDevice) Remove() {
+	h.Lock()
+	defer h.Unlock()
+	if h.isRemoved {
 		return
 	}
-	if h.client == nil {
+	h.isRemoved = true
+	if h.unobserve != nil {
+		h.unobserve()
+		h.unobserve = nil
+	}
+	if h.device == nil || h.info == nil {
+		return
+	}
+	if err := client.DeleteDevice(h.info, h.client.transport); err != nil {
+		log.Printf("[%s] Error removing device: %v", h.Topic, err)
 		return
 	}
+	h.device = nil
+	log.Printf("[%s] Removed", h.Topic)
+}
+
+func (h *HemtjanstDevice) removed() bool {
+	h.RLock()
+	defer h.RUnlock()
+	return h.isRemoved
+}
+
+// ReplaceMember swaps one member for another, i.e. when a group has been
+// announced again
+func (h *HemtjanstDevice) ReplaceMember(old, member *HemtjanstDevice) {
+	h.Lock()
+	defer h.Unlock()
+	for i, m := range h.members {
+		if m == old {
+			h.members[i] = member
+		}
+	}
+	h.init()
+}
+
+// featuresChanged returns true if the device has been announced with
+// a different set of features than it would be now
+func (h *HemtjanstDevice) featuresChanged() bool {
+	h.RLock()
+	defer h.RUnlock()
+	if !h.isRunning || h.isRemoved || h.info == nil {
+		return false
+	}
+	dev := h.buildInfo()
+	if dev == nil || len(dev.Features) != len(h.info.Features) {
+		return dev != nil
+	}
+	for name := range dev.Features {
+		if _, ok := h.info.Features[name]; !ok {
+			return true
+		}
+	}
+	return false
+}
+
+// buildInfo describes the device and its features as they should be
+// announced, nil means it's not ready yet
+func (h *HemtjanstDevice) buildInfo() *device.Info {
 	var dev *device.Info
 
 	lType := lTypeNone
+	// The color temperatures all lights can do
+	minMireds, maxMireds := 0, math.MaxInt32
 	if h.isGroup {
 		if h.group == nil {
-			return
+			return nil
 		}
 		if h.group.Members == nil || len(h.group.Members) != len(h.members) {
-			return
+			return nil
 		}
 
 		dev = &device.Info{
@@ -133,6 +244,13 @@ func (h *HemtjanstDevice) init() {
 				if l := d.accessory.Light(); l != nil {
 					if l.HasColorTemperature() {
 						lType = lTypeTemp
+						coldest, warmest := d.accessory.DeviceInfo.MiredRange()
+						if coldest > minMireds {
+							minMireds = coldest
+						}
+						if warmest < maxMireds {
+							maxMireds = warmest
+						}
 					}
 				}
 				if d.accessory.DeviceInfo.IsRGBModel() {
@@ -143,18 +261,15 @@ func (h *HemtjanstDevice) init() {
 		}
 
 		if !hasLight {
-			return
+			return nil
 		}
 		dev.Type = "lightbulb"
 		dev.Features["on"] = &feature.Info{}
 		dev.Features["brightness"] = &feature.Info{}
+		dev.Features["transitionTime"] = &feature.Info{Min: 0, Max: 6553}
 	} else {
-		if h.accessory == nil || len(h.members) == 0 {
-			return
-		}
-		owner := h.members[0]
-		if owner.group == nil {
-			return
+		if h.accessory == nil {
+			return nil
 		}
 
 		dev = &device.Info{
@@ -169,8 +284,10 @@ func (h *HemtjanstDevice) init() {
 			dev.Type = "lightbulb"
 			dev.Features["on"] = &feature.Info{}
 			dev.Features["brightness"] = &feature.Info{}
+			dev.Features["transitionTime"] = &feature.Info{Min: 0, Max: 6553}
 			if h.accessory.Light().HasColorTemperature() {
 				lType = lTypeTemp
+				minMireds, maxMireds = h.accessory.DeviceInfo.MiredRange()
 			}
 			if h.accessory.DeviceInfo.IsRGBModel() {
 				lType = lTypeRgb
@@ -179,32 +296,76 @@ func (h *HemtjanstDevice) init() {
 			dev.Type = "outlet"
 			dev.Features["on"] = &feature.Info{}
 			dev.Features["outletInUse"] = &feature.Info{}
+			if p := h.accessory.Plug(); p != nil {
+				if p.ActivePower != nil {
+					dev.Features["currentPower"] = &feature.Info{}
+				}
+				if p.CumulativeActivePower != nil {
+					dev.Features["energy"] = &feature.Info{}
+				}
+			}
 		} else if h.accessory.IsBlind() {
-			h.blind = &blindInfo{direction: blindStopped}
 			dev.Type = "windowCovering"
 			dev.Features["targetPosition"] = &feature.Info{Min: 0, Max: 100, Step: 1}
 			dev.Features["currentPosition"] = &feature.Info{Min: 0, Max: 100, Step: 1}
 			dev.Features["positionState"] = &feature.Info{Min: 0, Max: 2, Step: 1}
+		} else if h.accessory.IsMotionSensor() {
+			dev.Type = "motionSensor"
+			dev.Features["motionDetected"] = &feature.Info{}
+			dev.Features["reachable"] = &feature.Info{}
+		} else if h.accessory.IsRemote() {
+			// Remotes, dimmers and shortcut buttons, presses aren't
+			// reported by the gateway so this is mostly to keep an eye
+			// on their batteries
+			dev.Type = "statelessProgrammableSwitch"
+			dev.Features["programmableSwitchEvent"] = &feature.Info{Min: 0, Max: 2, Step: 1}
+			dev.Features["reachable"] = &feature.Info{}
+		}
+		if h.accessory.DeviceInfo.HasBattery() {
+			dev.Features["batteryLevel"] = &feature.Info{Min: 0, Max: 100, Step: 1}
+			dev.Features["statusLowBattery"] = &feature.Info{Min: 0, Max: 1, Step: 1}
+			dev.Features["chargingState"] = &feature.Info{Min: 0, Max: 2, Step: 1}
 		}
 	}
 
 	switch lType {
 	case lTypeTemp:
-		dev.Features["colorTemperature"] = &feature.Info{}
+		dev.Features["colorTemperature"] = &feature.Info{Min: minMireds, Max: maxMireds, Step: 1}
 	case lTypeRgb:
 		dev.Features["hue"] = &feature.Info{}
 		dev.Features["saturation"] = &feature.Info{}
 		dev.Features["color"] = &feature.Info{}
 	}
 
+	return dev
+}
+
+func (h *HemtjanstDevice) init() {
+	if h.isRunning || h.isRemoved {
+		return
+	}
+	if h.client == nil {
+		return
+	}
+	dev := h.buildInfo()
+	if dev == nil {
+		return
+	}
 	if dev.Type == "" {
 		log.Printf("Unsupported device: %+v", dev)
 		return
 	}
+	if !h.isGroup && h.accessory.IsBlind() {
+		h.blind = &blindInfo{direction: blindStopped}
+	}
+	if !h.isGroup && h.accessory.IsMotionSensor() {
+		h.motion = &motionInfo{}
+	}
 
 	h.isRunning = true
 	var err error
 	if !h.shouldSkip() {
+		h.info = dev
 		h.device, err = client.NewDevice(dev, h.client.transport)
 		if err != nil {
 			log.Printf("Error creating device: %s", err)
@@ -215,17 +376,14 @@ func (h *HemtjanstDevice) init() {
 			_ = ft.OnSetFunc(func(val string) {
 				h.onDeviceSet(ft.Name(), val)
 			})
-			err := h.publish(ft.Name())
-			if err != nil {
-				log.Printf("Error publishing to %s: %s", ft.Name(), err)
-			}
 		}
+		h.publishAll()
 		log.Printf("[%s] Started", h.Topic)
 	}
 	if h.isGroup && h.group != nil {
-		h.group.Observe(h.onTradfriChange)
+		h.unobserve = h.group.Observe(h.onTradfriChange)
 	} else if h.accessory != nil {
-		h.accessory.Observe(h.onTradfriChange)
+		h.unobserve = h.accessory.Observe(h.onTradfriChange)
 	}
 }
 
@@ -235,36 +393,36 @@ func (h *HemtjanstDevice) onDeviceSet(feature string, newValue string) {
 	case "on":
 		on := newValue != "0" && strings.ToLower(newValue) != "false"
 		if h.isGroup && h.group != nil {
+			h.fade(h.group)
 			h.group.SetOn(on)
 		} else if h.accessory != nil {
+			h.fade(h.accessory)
 			h.accessory.SetOn(on)
 		}
 	case "brightness":
 		if dim, err := strconv.Atoi(newValue); err == nil {
 			if h.isGroup && h.group != nil {
+				h.fade(h.group)
 				h.group.SetDim(dim)
 			} else if h.accessory != nil {
+				h.fade(h.accessory)
 				h.accessory.SetDim(dim)
 			}
 		}
 	case "colorTemperature":
-		if temp, err := strconv.Atoi(newValue); err == nil {
-			newTemp := "warm"
-			if temp < 150 {
-				newTemp = "cold"
-			} else if temp < 250 {
-				newTemp = "normal"
-			}
+		if mireds, err := strconv.Atoi(newValue); err == nil {
 			if h.isGroup && h.group != nil {
 				for _, m := range h.members {
 					if m.accessory != nil && m.accessory.Light() != nil {
 						if m.accessory.Light().HasColorTemperature() {
-							m.accessory.SetColorTemp(newTemp)
+							h.fade(m.accessory)
+							m.setMireds(mireds)
 						}
 					}
 				}
 			} else if h.accessory != nil {
-				h.accessory.SetColorTemp(newTemp)
+				h.fade(h.accessory)
+				h.setMireds(mireds)
 			}
 		}
 	case "color":
@@ -279,6 +437,16 @@ func (h *HemtjanstDevice) onDeviceSet(feature string, newValue string) {
 			h.lastSaturation = &saturation
 			h.updateColor("")
 		}
+	case "transitionTime":
+		if secs, err := strconv.ParseFloat(newValue, 64); err == nil && secs >= 0 {
+			t := time.Duration(secs * float64(time.Second))
+			h.transitionLock.Lock()
+			h.transition = &t
+			h.transitionLock.Unlock()
+			if err := h.publish("transitionTime"); err != nil {
+				log.Printf("Error publishing transitionTime: %v", err)
+			}
+		}
 	case "targetPosition":
 		if pos, err := strconv.Atoi(newValue); err == nil && pos >= 0 && pos <= 100 {
 			if h.isGroup && h.group != nil {
@@ -299,40 +467,93 @@ func (h *HemtjanstDevice) onDeviceSet(feature string, newValue string) {
 	}
 }
 
+// transitionTime returns how long the device fades, as requested from
+// Hemtjänst or else as configured
+func (h *HemtjanstDevice) transitionTime() time.Duration {
+	h.transitionLock.RLock()
+	defer h.transitionLock.RUnlock()
+	if h.transition != nil {
+		return *h.transition
+	}
+	if h.isGroup && h.group != nil {
+		return h.client.transitionFor(h.Topic, h.group.Name)
+	} else if h.accessory != nil {
+		return h.client.transitionFor(h.Topic, h.accessory.Name)
+	}
+	return h.client.Transition
+}
+
+// fade makes the next change to t fade over the transition time of the
+// device, if it has one
+func (h *HemtjanstDevice) fade(t fader) {
+	if d := h.transitionTime(); d > 0 {
+		t.SetTransitionTime(d)
+	}
+}
+
+// setMireds sets the color temperature of a light, limited to what the
+// model can do
+func (h *HemtjanstDevice) setMireds(mireds int) {
+	coldest, warmest := h.accessory.DeviceInfo.MiredRange()
+	if mireds < coldest {
+		mireds = coldest
+	} else if mireds > warmest {
+		mireds = warmest
+	}
+	h.accessory.SetMireds(mireds)
+}
+
+// updateColor sets hue and saturation as they are when rgb is empty, or
+// else the color as xy and the brightness from its value
 func (h *HemtjanstDevice) updateColor(rgb string) {
-	var newColor colorful.Color
+	var set func(a *tradfri.Accessory)
+	dim := -1
 
 	if rgb == "" {
 		if h.lastHue == nil || h.lastSaturation == nil {
 			return
 		}
-		hue := *h.lastHue
-		sat := *h.lastSaturation
-
-		newColor = colorful.Hsv(float64(hue), float64(sat)/100, float64(1))
+		hue := float64(*h.lastHue)
+		sat := float64(*h.lastSaturation) / 100
+		set = func(a *tradfri.Accessory) {
+			a.SetHueSat(hue, sat)
+		}
 	} else {
 		if rgb[0] != '#' {
 			rgb = "#" + rgb
 		}
-		var err error
-		newColor, err = colorful.Hex(rgb)
+		newColor, err := colorful.Hex(rgb)
 		if err != nil {
 			return
 		}
+		if _, _, v := newColor.Hsv(); v > 0 {
+			dim = int(v*100 + 0.5)
+		}
+		set = func(a *tradfri.Accessory) {
+			a.SetColor(newColor)
+		}
 	}
 
 	if h.isGroup && h.group != nil {
 		for _, m := range h.members {
 			if m.accessory != nil && m.accessory.Light() != nil {
 				if m.accessory.DeviceInfo.IsRGBModel() {
-					m.accessory.SetColor(newColor)
+					h.fade(m.accessory)
+					set(m.accessory)
 				}
 			}
 		}
+		if dim >= 0 {
+			h.fade(h.group)
+			h.group.SetDim(dim)
+		}
 	} else if h.accessory != nil {
-		h.accessory.SetColor(newColor)
+		h.fade(h.accessory)
+		set(h.accessory)
+		if dim >= 0 {
+			h.accessory.SetDim(dim)
+		}
 	}
-
 }
 
 func (h *HemtjanstDevice) dimmable() *tradfri.Dimmable {
@@ -388,6 +609,10 @@ func (h *HemtjanstDevice) lightSetting() *tradfri.LightSetting {
 }
 
 func (h *HemtjanstDevice) featureVal(feature string) (string, error) {
+	if feature == "transitionTime" {
+		// Groups have their own, unlike everything else
+		return strconv.FormatFloat(h.transitionTime().Seconds(), 'f', -1, 64), nil
+	}
 	if h.isGroup {
 		min := math.MaxInt32
 		max := math.MinInt32
@@ -437,8 +662,10 @@ func (h *HemtjanstDevice) featureVal(feature string) (string, error) {
 			}
 			return last, nil
 		case "outletInUse":
-			// Currently no way of detecting
-			return "1", nil
+			if max == 1 {
+				return "1", nil
+			}
+			return "0", nil
 		case "currentPosition", "targetPosition", "positionState":
 			return "2", nil
 		}
@@ -464,14 +691,7 @@ func (h *HemtjanstDevice) featureVal(feature string) (string, error) {
 		if ls == nil || !ls.HasColorTemperature() {
 			return "", fmt.Errorf("device doesn't support %s", feature)
 		}
-		switch ls.GetColorName() {
-		case "cold":
-			return "111", nil
-		case "warm":
-			return "400", nil
-		default:
-			return "222", nil
-		}
+		return strconv.Itoa(ls.GetMireds()), nil
 	case "reachable":
 		if h.isGroup || h.accessory == nil {
 
@@ -485,15 +705,15 @@ func (h *HemtjanstDevice) featureVal(feature string) (string, error) {
 		if ls == nil {
 			return "", fmt.Errorf("device doesn't support %s", feature)
 		}
-		hue, _, _ := ls.GetColor().Hsv()
-		return strconv.Itoa(int(hue)), nil
+		hue, _ := ls.GetHueSat()
+		return strconv.Itoa(int(hue+0.5) % 360), nil
 	case "saturation":
 		ls := h.lightSetting()
 		if ls == nil {
 			return "", fmt.Errorf("device doesn't support %s", feature)
 		}
-		_, sat, _ := ls.GetColor().Hsv()
-		return strconv.Itoa(int(sat * 100)), nil
+		_, sat := ls.GetHueSat()
+		return strconv.Itoa(int(sat*100 + 0.5)), nil
 	case "color":
 		ls := h.lightSetting()
 		if ls == nil {
@@ -501,8 +721,23 @@ func (h *HemtjanstDevice) featureVal(feature string) (string, error) {
 		}
 		return ls.GetColor().Hex(), nil
 	case "outletInUse":
-		// Currently no way of detecting
+		p := h.accessory.Plug()
+		if p == nil {
+			return "", fmt.Errorf("device doesn't support %s", feature)
+		}
+		// Without a power measurement the best guess is whether it's on
+		if p.ActivePower != nil && *p.ActivePower < h.client.InUsePower || !p.IsOn() {
+			return "0", nil
+		}
 		return "1", nil
+	case "currentPower":
+		if p := h.accessory.Plug(); p != nil && p.ActivePower != nil {
+			return strconv.FormatFloat(*p.ActivePower, 'f', -1, 64), nil
+		}
+	case "energy":
+		if p := h.accessory.Plug(); p != nil && p.CumulativeActivePower != nil {
+			return strconv.FormatFloat(*p.CumulativeActivePower, 'f', -1, 64), nil
+		}
 	case "currentPosition":
 		if bl := h.accessory.Blind(); bl != nil {
 			return strconv.Itoa(100 - bl.Pos()), nil
@@ -527,15 +762,44 @@ func (h *HemtjanstDevice) featureVal(feature string) (string, error) {
 		if h.blind != nil {
 			return strconv.Itoa(int(h.blind.direction)), nil
 		}
+	case "motionDetected":
+		if h.motion != nil {
+			if h.motion.isDetected() {
+				return "1", nil
+			}
+			return "0", nil
+		}
+	case "batteryLevel":
+		if h.accessory != nil && h.accessory.DeviceInfo != nil {
+			return strconv.Itoa(h.accessory.DeviceInfo.Battery), nil
+		}
+	case "statusLowBattery":
+		if h.accessory != nil && h.accessory.DeviceInfo != nil {
+			if h.accessory.DeviceInfo.Battery < h.client.LowBattery {
+				return "1", nil
+			}
+			return "0", nil
+		}
+	case "chargingState":
+		if h.accessory != nil {
+			// Blinds have a rechargeable battery, but whether it's charging
+			// isn't reported
+			if h.accessory.IsBlind() {
+				return "0", nil
+			}
+			return "2", nil
+		}
 	}
 	return "", fmt.Errorf("device doesn't support %s", feature)
 }
 
 func (h *HemtjanstDevice) publish(feature string) error {
 	var err error
-	if !h.isGroup && h.accessory.IsLight() && len(h.members) == 1 {
-		if err := h.members[0].publish(feature); err != nil {
-			return err
+	if !h.isGroup && h.accessory.IsLight() {
+		for _, grp := range h.members {
+			if err := grp.publish(feature); err != nil {
+				return err
+			}
 		}
 	}
 	newVal, err := h.featureVal(feature)
@@ -549,23 +813,66 @@ func (h *HemtjanstDevice) publish(feature string) error {
 	return h.device.Feature(feature).Update(newVal)
 }
 
+// hasFeature returns true if the device was announced with feature
+func (h *HemtjanstDevice) hasFeature(feature string) bool {
+	h.RLock()
+	defer h.RUnlock()
+	if h.info == nil {
+		return false
+	}
+	_, ok := h.info.Features[feature]
+	return ok
+}
+
+func (h *HemtjanstDevice) publishAll() {
+	if h.device == nil {
+		return
+	}
+	for _, ft := range h.device.Features() {
+		if ft.Name() == "programmableSwitchEvent" {
+			// Only published for a press, which the gateway doesn't report
+			continue
+		}
+		if err := h.publish(ft.Name()); err != nil {
+			log.Printf("Error publishing to %s: %s", ft.Name(), err)
+		}
+	}
+}
+
 func unptr(i interface{}) interface{} {
-	if rf := reflect.ValueOf(i); !rf.IsNil() && rf.Type().Kind() == reflect.Ptr {
+	if rf := reflect.ValueOf(i); rf.Kind() == reflect.Ptr && !rf.IsNil() {
 		return rf.Elem().Interface()
 	}
 	return i
 }
 
 func (h *HemtjanstDevice) onTradfriChange(change []*tradfri.ObservedChange) {
+	if h.removed() {
+		return
+	}
 	colorUpdated := false
 	for _, ch := range change {
 		log.Printf("[%s] %s changed from %v to %v", h.Topic, ch.Field, unptr(ch.OldValue), unptr(ch.NewValue))
 		switch ch.Field {
 		case "Dim":
 			h.publish("brightness")
+			if h.hasFeature("color") {
+				h.publish("color")
+			}
 		case "On":
 			h.publish("on")
-		case "Color", "ColorX", "ColorY", "Hue", "Saturation":
+			if h.hasFeature("outletInUse") {
+				h.publish("outletInUse")
+			}
+			if on, ok := ch.NewValue.(*tradfri.YesNo); ok && h.isGroup && on != nil && on.Bool() &&
+				h.group != nil && time.Since(h.group.LastSent()) > ownChangeWindow {
+				// Motion sensors turn their groups on, which is all the
+				// gateway lets on about them
+				for _, m := range h.Members() {
+					m.onGroupOn()
+				}
+			}
+		case "Color", "ColorX", "ColorY", "Hue", "Saturation", "Mireds":
 			if !colorUpdated {
 				colorUpdated = true
 				h.publish("colorTemperature")
@@ -573,8 +880,31 @@ func (h *HemtjanstDevice) onTradfriChange(change []*tradfri.ObservedChange) {
 				h.publish("saturation")
 				h.publish("color")
 			}
+		case "ActivePower":
+			if h.hasFeature("currentPower") {
+				h.publish("currentPower")
+			}
+			if h.hasFeature("outletInUse") {
+				h.publish("outletInUse")
+			}
+		case "CumulativeActivePower":
+			if h.hasFeature("energy") {
+				h.publish("energy")
+			}
 		case "Alive":
 			h.publish("reachable")
+		case "LastSeen":
+			// Sensors are also seen when they report their battery, only
+			// count it along with a group turning on
+			if h.motion != nil && h.motion.groupOnWithin(motionWindow) &&
+				time.Since(h.accessory.LastSeenTime()) < h.client.OccupancyTimeout {
+				h.onMotion()
+			}
+		case "Battery":
+			if h.hasFeature("batteryLevel") {
+				h.publish("batteryLevel")
+				h.publish("statusLowBattery")
+			}
 		case "Position":
 			h.publish("currentPosition")
 			if h.blind != nil {
@@ -585,6 +915,70 @@ func (h *HemtjanstDevice) onTradfriChange(change []*tradfri.ObservedChange) {
 	}
 }
 
+// onMotion reports motion from a motion sensor, until there has been no
+// activity for the occupancy timeout
+func (h *HemtjanstDevice) onMotion() {
+	if h.motion == nil {
+		return
+	}
+	if h.motion.onActivity(h.client.OccupancyTimeout, h.publish) {
+		if err := h.publish("motionDetected"); err != nil {
+			log.Printf("Error publishing motionDetected: %v", err)
+		}
+	}
+}
+
+// onGroupOn reports motion from a motion sensor whose group was turned on
+func (h *HemtjanstDevice) onGroupOn() {
+	if h.motion == nil {
+		return
+	}
+	h.motion.Lock()
+	h.motion.groupOn = time.Now()
+	h.motion.Unlock()
+	h.onMotion()
+}
+
+func (m *motionInfo) groupOnWithin(d time.Duration) bool {
+	m.RLock()
+	defer m.RUnlock()
+	return time.Since(m.groupOn) < d
+}
+
+func (m *motionInfo) isDetected() bool {
+	m.RLock()
+	defer m.RUnlock()
+	return m.detected
+}
+
+// onActivity restarts the occupancy timer, cb is called when it runs out.
+// Returns true if motion wasn't already detected.
+func (m *motionInfo) onActivity(timeout time.Duration, cb func(string) error) bool {
+	m.Lock()
+	defer m.Unlock()
+	if m.timer != nil {
+		m.timer.Stop()
+	}
+	var tmr *time.Timer
+	tmr = time.AfterFunc(timeout, func() {
+		m.Lock()
+		if m.timer != tmr {
+			m.Unlock()
+			return
+		}
+		m.timer = nil
+		m.detected = false
+		m.Unlock()
+		_ = cb("motionDetected")
+	})
+	m.timer = tmr
+	if m.detected {
+		return false
+	}
+	m.detected = true
+	return true
+}
+
 func (b *blindInfo) onUpdate(blind *tradfri.Blind, cb func(string) error) {
 	b.Lock()
 	defer b.Unlock()
@@ -4,6 +4,7 @@ go 1.12
 
 require (
 	github.com/lucasb-eyer/go-colorful v1.0.2
+	github.com/pion/dtls v1.5.4
 	github.com/satori/go.uuid v1.2.0
 	lib.hemtjan.st v0.5.0
 )
@@ -2,155 +2,375 @@ package sladdlos
 
 import (
 	"context"
+	"encoding/json"
 	"hemtjan.st/sladdlos/tradfri"
 	"lib.hemtjan.st/device"
+	"log"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 type HemtjanstClient struct {
 	sync.RWMutex
-	Id           string
-	Announce     bool
-	SkipGroup    bool
-	SkipBulb     bool
-	transport    device.Transport
-	tree         *tradfri.Tree
-	devices      map[string]*HemtjanstDevice
-	groups       map[int]*tradfri.Group
-	accessories  map[int]*tradfri.Accessory
-	newDevChan   chan *tradfri.Accessory
-	newGroupChan chan *tradfri.Group
+	Id string
+	// Namespace is inserted into the topic of every device, to keep the
+	// devices of multiple gateways apart
+	Namespace string
+	Announce  bool
+	SkipGroup bool
+	SkipBulb  bool
+	SkipScene bool
+	// SettleTime is how long to wait for an accessory to show up in a group
+	// before announcing it on its own
+	SettleTime time.Duration
+	// OccupancyTimeout is how long a motion sensor reports motion after the
+	// last sign of activity
+	OccupancyTimeout time.Duration
+	// LowBattery is the battery level in percent below which a battery is
+	// reported as low
+	LowBattery int
+	// InUsePower is the power in watts above which an outlet that measures
+	// it is in use
+	InUsePower float64
+	// Transition is how long lights fade when they're changed, 0 leaves it
+	// to the gateway
+	Transition time.Duration
+	// Transitions overrides Transition for the devices with these names or
+	// topics
+	Transitions map[string]time.Duration
+	transport   device.Transport
+	tree        *tradfri.Tree
+	devices     map[string]*HemtjanstDevice
+	scenes      map[string]*HemtjanstScene
+	groups      map[int]*tradfri.Group
+	accessories map[int]*tradfri.Accessory
+	seen        map[int]time.Time
+	settleTimer *time.Timer
 }
 
 func NewHemtjanstClient(tree *tradfri.Tree, transport device.Transport, id string) *HemtjanstClient {
 	h := &HemtjanstClient{
-		tree:         tree,
-		transport:    transport,
-		Id:           id,
-		SkipBulb:     false,
-		SkipGroup:    false,
-		devices:      map[string]*HemtjanstDevice{},
-		newDevChan:   make(chan *tradfri.Accessory),
-		newGroupChan: make(chan *tradfri.Group),
-		groups:       map[int]*tradfri.Group{},
-		accessories:  map[int]*tradfri.Accessory{},
-	}
-	tree.AddCallback(h)
+		tree:             tree,
+		transport:        transport,
+		Id:               id,
+		SkipBulb:         false,
+		SkipGroup:        false,
+		SettleTime:       10 * time.Second,
+		OccupancyTimeout: 3 * time.Minute,
+		LowBattery:       15,
+		InUsePower:       2,
+		devices:          map[string]*HemtjanstDevice{},
+		scenes:           map[string]*HemtjanstScene{},
+		groups:           map[int]*tradfri.Group{},
+		accessories:      map[int]*tradfri.Accessory{},
+		seen:             map[int]time.Time{},
+	}
+	tree.AddErrorCallback(h)
 	return h
 }
 
-func topicFor(a tradfri.Instance, t ...string) string {
+// transitionFor returns how long the device with topic and name fades
+func (h *HemtjanstClient) transitionFor(topic, name string) time.Duration {
+	if t, ok := h.Transitions[topic]; ok {
+		return t
+	}
+	if t, ok := h.Transitions[name]; ok {
+		return t
+	}
+	return h.Transition
+}
+
+// topicFor returns i.e. light/grp-3, or light/<namespace>/grp-3 if the
+// client has a namespace
+func (h *HemtjanstClient) topicFor(a tradfri.Instance, t ...string) string {
+	if h.Namespace != "" && len(t) > 1 {
+		t = append(t[:len(t)-1:len(t)-1], h.Namespace, t[len(t)-1])
+	}
 	return strings.Join(t, "/") + "-" + strconv.Itoa(a.GetInstanceID())
 }
 
+func (h *HemtjanstClient) accessoryTopic(a *tradfri.Accessory) string {
+	if a.IsLight() {
+		return h.topicFor(a, "light", "bulb")
+	} else if a.IsPlug() {
+		return h.topicFor(a, "outlet", "plug")
+	} else if a.IsBlind() {
+		return h.topicFor(a, "windowCovering", "blind")
+	} else if a.IsMotionSensor() {
+		return h.topicFor(a, "motionSensor", "motion")
+	} else if a.IsRemote() {
+		return h.topicFor(a, "remote", "remote")
+	}
+	return h.topicFor(a, "unknown", "unknown")
+}
+
 func (h *HemtjanstClient) Start(ctx context.Context) {
-	for {
-		select {
-		case d, op := <-h.newDevChan:
-			if !op {
-				return
-			}
-			go func(d *tradfri.Accessory) {
-				h.Lock()
-				defer h.Unlock()
-				if _, ok := h.accessories[d.GetInstanceID()]; !ok {
-					h.accessories[d.GetInstanceID()] = d
+	events := h.tree.Subscribe(ctx, tradfri.KindFilter(tradfri.KindAccessory, tradfri.KindGroup, tradfri.KindScene))
+	for e := range events {
+		h.onEvent(e)
+	}
+}
+
+func (h *HemtjanstClient) onEvent(e *tradfri.Event) {
+	h.Lock()
+	defer h.Unlock()
+	switch e.Kind {
+	case tradfri.KindAccessory:
+		id := e.Accessory.GetInstanceID()
+		switch e.Type {
+		case tradfri.EventAdded:
+			h.accessories[id] = e.Accessory
+			h.seen[id] = time.Now()
+			h.ensureDevices()
+		case tradfri.EventRemoved:
+			delete(h.accessories, id)
+			delete(h.seen, id)
+			h.removeDevice(h.accessoryTopic(e.Accessory))
+		}
+	case tradfri.KindGroup:
+		id := e.Group.GetInstanceID()
+		switch e.Type {
+		case tradfri.EventAdded:
+			h.groups[id] = e.Group
+			h.ensureDevices()
+		case tradfri.EventChanged:
+			for _, ch := range e.Changes {
+				if ch.Field == "Members" {
+					h.ensureDevices()
+					break
 				}
-				h.ensureDevices()
-			}(d)
-		case g, op := <-h.newGroupChan:
-			if !op {
-				return
 			}
-			go func(g *tradfri.Group) {
-				h.Lock()
-				defer h.Unlock()
-				if _, ok := h.groups[g.GetInstanceID()]; !ok {
-					h.groups[g.GetInstanceID()] = g
-				}
-				h.ensureDevices()
-			}(g)
-		case <-ctx.Done():
-			return
+		case tradfri.EventRemoved:
+			delete(h.groups, id)
+			// Members stay announced on their own, or as part of their
+			// other groups
+			h.removeDevice(h.topicFor(e.Group, "light", "grp"))
+			h.ensureDevices()
+		}
+	case tradfri.KindScene:
+		topic := h.topicFor(e.Scene, "scene", "scene")
+		switch e.Type {
+		case tradfri.EventAdded:
+			if _, ok := h.scenes[topic]; !ok {
+				h.scenes[topic] = NewHemtjanstScene(h, topic, e.Group, e.Scene)
+			}
+		case tradfri.EventRemoved:
+			if sc, ok := h.scenes[topic]; ok {
+				sc.Remove()
+				delete(h.scenes, topic)
+			}
 		}
 	}
 }
 
 func (h *HemtjanstClient) ensureDevices() {
-	ownerGroup := map[int]int{}
+	ownerGroups := map[int][]int{}
 
 	for _, grp := range h.groups {
-		topic := topicFor(grp, "light", "grp")
+		for _, member := range grp.Members {
+			ownerGroups[member] = append(ownerGroups[member], grp.GetInstanceID())
+		}
+		topic := h.topicFor(grp, "light", "grp")
 		if _, ok := h.devices[topic]; ok {
 			continue
 		}
 		dev := NewHemtjanstGroup(h, topic, grp)
 		h.devices[topic] = dev
-
-		if grp.Members != nil {
-			for _, member := range grp.Members {
-				ownerGroup[member] = grp.GetInstanceID()
-			}
-		}
 	}
 
 	for _, accessory := range h.accessories {
-		var topic string
-		if accessory.IsLight() {
-			topic = topicFor(accessory, "light", "bulb")
-		} else if accessory.IsPlug() {
-			topic = topicFor(accessory, "outlet", "plug")
-		} else if accessory.IsBlind() {
-			topic = topicFor(accessory, "windowCovering", "blind")
-		} else if accessory.IsRemote() {
-			topic = topicFor(accessory, "remote", "remote")
-		} else {
-			topic = topicFor(accessory, "unknown", "unknown")
+		topic := h.accessoryTopic(accessory)
+
+		grpIds := ownerGroups[accessory.GetInstanceID()]
+		sort.Ints(grpIds)
+		owners := []*HemtjanstDevice{}
+		for _, grpId := range grpIds {
+			if owner, ok := h.groups[grpId]; ok {
+				if ownerDev, ok := h.devices[h.topicFor(owner, "light", "grp")]; ok {
+					owners = append(owners, ownerDev)
+				}
+			}
 		}
 
-		if _, ok := h.devices[topic]; ok {
+		if dev, ok := h.devices[topic]; ok {
+			h.reparent(dev, owners)
 			continue
 		}
-		var ownerDev *HemtjanstDevice
-
-		var owner *tradfri.Group
-		if grpId, ok := ownerGroup[accessory.GetInstanceID()]; ok {
-			if owner, ok = h.groups[grpId]; !ok {
+		if len(owners) == 0 {
+			// Give it some time to show up in a group before announcing it
+			// on its own
+			if wait := h.SettleTime - time.Since(h.seen[accessory.GetInstanceID()]); wait > 0 {
+				h.settleLater(wait)
 				continue
 			}
-		} else {
-			// Wait until we have the group
-			continue
-		}
-		ownerTopic := topicFor(owner, "light", "grp")
-		var ok bool
-		if ownerDev, ok = h.devices[ownerTopic]; !ok {
-			continue
 		}
 
-		dev := NewHemtjanstAccessory(h, topic, accessory, ownerDev)
+		dev := NewHemtjanstAccessory(h, topic, accessory, owners...)
 		h.devices[topic] = dev
-		if ownerDev != nil {
+		for _, ownerDev := range owners {
 			ownerDev.AddMember(dev)
 		}
 	}
 
+	for _, grp := range h.groups {
+		topic := h.topicFor(grp, "light", "grp")
+		if dev, ok := h.devices[topic]; ok && dev.featuresChanged() {
+			h.reannounce(dev)
+		}
+	}
+}
+
+// settleLater runs ensureDevices again after wait, must be called with the
+// client locked
+func (h *HemtjanstClient) settleLater(wait time.Duration) {
+	if h.settleTimer != nil {
+		return
+	}
+	h.settleTimer = time.AfterFunc(wait, func() {
+		h.Lock()
+		defer h.Unlock()
+		h.settleTimer = nil
+		h.ensureDevices()
+	})
 }
 
-func (h *HemtjanstClient) OnNewAccessory(d *tradfri.Accessory) {
-	go func() {
-		h.newDevChan <- d
-	}()
+// reparent moves an accessory to the groups it's in according to the
+// gateway, must be called with the client locked
+func (h *HemtjanstClient) reparent(dev *HemtjanstDevice, owners []*HemtjanstDevice) {
+	old := dev.Members()
+	isOwner := func(list []*HemtjanstDevice, grp *HemtjanstDevice) bool {
+		for _, o := range list {
+			if o == grp {
+				return true
+			}
+		}
+		return false
+	}
+	for _, o := range old {
+		if !isOwner(owners, o) {
+			o.RemoveMember(dev)
+			dev.RemoveMember(o)
+			o.publishAll()
+			log.Printf("[%s] Removed from %s", dev.Topic, o.Topic)
+		}
+	}
+	for _, o := range owners {
+		if !isOwner(old, o) {
+			dev.AddMember(o)
+			o.AddMember(dev)
+			o.publishAll()
+			log.Printf("[%s] Added to %s", dev.Topic, o.Topic)
+		}
+	}
 }
 
-func (h *HemtjanstClient) OnNewGroup(g *tradfri.Group) {
-	go func() {
-		h.newGroupChan <- g
-	}()
+// reannounce replaces a group device whose features have changed with
+// a new one, must be called with the client locked
+func (h *HemtjanstClient) reannounce(dev *HemtjanstDevice) {
+	log.Printf("[%s] Features changed, announcing again", dev.Topic)
+	members := dev.Members()
+	dev.Remove()
+	nd := NewHemtjanstGroup(h, dev.Topic, dev.group)
+	h.devices[dev.Topic] = nd
+	for _, m := range members {
+		m.ReplaceMember(dev, nd)
+		nd.AddMember(m)
+	}
 }
 
-func (h *HemtjanstClient) OnNewScene(g *tradfri.Group, s *tradfri.Scene) {
+// removeDevice must be called with the client locked
+func (h *HemtjanstClient) removeDevice(topic string) {
+	dev, ok := h.devices[topic]
+	if !ok {
+		return
+	}
+	for _, m := range dev.Members() {
+		m.RemoveMember(dev)
+	}
+	dev.Remove()
+	delete(h.devices, topic)
+}
 
+// ReportBatteries publishes the devices with a low battery to topic once
+// the tree has settled after starting and then every interval, until the
+// context is cancelled
+func (h *HemtjanstClient) ReportBatteries(ctx context.Context, topic string, interval time.Duration) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(h.SettleTime):
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		b, err := json.Marshal(h.lowBatteries())
+		if err != nil {
+			log.Printf("Error encoding battery report: %v", err)
+		} else {
+			h.transport.Publish(topic, b, true)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type lowBattery struct {
+	Topic        string `json:"topic"`
+	Name         string `json:"name"`
+	BatteryLevel int    `json:"batteryLevel"`
+	// LastSeen is when the device was last heard from, as a unix timestamp
+	LastSeen int64 `json:"lastSeen"`
+}
+
+func (h *HemtjanstClient) lowBatteries() []*lowBattery {
+	h.RLock()
+	defer h.RUnlock()
+	low := []*lowBattery{}
+	for _, acc := range h.accessories {
+		if acc.DeviceInfo == nil || !acc.DeviceInfo.HasBattery() || acc.DeviceInfo.Battery >= h.LowBattery {
+			continue
+		}
+		low = append(low, &lowBattery{
+			Topic:        h.accessoryTopic(acc),
+			Name:         acc.Name,
+			BatteryLevel: acc.DeviceInfo.Battery,
+			LastSeen:     acc.LastSeen,
+		})
+	}
+	sort.Slice(low, func(i, j int) bool {
+		return low[i].Topic < low[j].Topic
+	})
+	for _, l := range low {
+		log.Printf("[%s] Battery low: %d%%", l.Topic, l.BatteryLevel)
+	}
+	return low
+}
+
+// OnError is called when a change couldn't be sent to the gateway, the
+// current state is published again so that Hemtjänst doesn't show the
+// value that never made it.
+func (h *HemtjanstClient) OnError(i tradfri.Instance, err error) {
+	var topic string
+	switch v := i.(type) {
+	case *tradfri.Accessory:
+		topic = h.accessoryTopic(v)
+	case *tradfri.Group:
+		topic = h.topicFor(v, "light", "grp")
+	default:
+		return
+	}
+	h.RLock()
+	dev, ok := h.devices[topic]
+	h.RUnlock()
+	if !ok {
+		return
+	}
+	log.Printf("[%s] Failed to update device: %v", topic, err)
+	dev.publishAll()
 }
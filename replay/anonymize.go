@@ -0,0 +1,70 @@
+package replay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// Anonymize replaces names (9001), serial numbers and the name, NTP server
+// and update URL of the gateway in a JSON payload. Anything that isn't JSON is
+// returned as is.
+func Anonymize(payload []byte) []byte {
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return payload
+	}
+	b, err := json.Marshal(scrub(v))
+	if err != nil {
+		return payload
+	}
+	return b
+}
+
+func scrub(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, sub := range val {
+			switch k {
+			case "9001":
+				if _, ok := sub.(string); !ok {
+					continue
+				}
+				if id, ok := val["9003"]; ok {
+					val[k] = fmt.Sprintf("Name %v", id)
+				} else {
+					val[k] = "Name"
+				}
+			case "9023":
+				val[k] = "ntp.example.com"
+			case "9035":
+				val[k] = "Gateway"
+			case "9056":
+				val[k] = ""
+			case "3":
+				// Device info, 2 is the serial number
+				if info, ok := sub.(map[string]interface{}); ok {
+					if _, ok := info["2"]; ok {
+						info["2"] = ""
+					}
+				}
+			case "payload":
+				// Commands and replies from tradfri-mqtt are wrapped
+				if s, ok := sub.(string); ok {
+					val[k] = string(Anonymize([]byte(s)))
+					continue
+				}
+				val[k] = scrub(sub)
+			default:
+				val[k] = scrub(sub)
+			}
+		}
+	case []interface{}:
+		for i := range val {
+			val[i] = scrub(val[i])
+		}
+	}
+	return v
+}
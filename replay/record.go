@@ -0,0 +1,94 @@
+package replay
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"lib.hemtjan.st/transport/mqtt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TypeRaw   = "raw"
+	TypeCmd   = "cmd"
+	TypeReply = "reply"
+)
+
+// Entry is one line of a capture
+type Entry struct {
+	Time time.Time `json:"time"`
+	// Gateway is the topic prefix of the tradfri-mqtt instance
+	Gateway string `json:"gateway"`
+	// Type is one of TypeRaw, TypeCmd or TypeReply
+	Type  string `json:"type"`
+	Topic string `json:"topic"`
+	// URI is set for TypeRaw, i.e. 15001/65536
+	URI     string `json:"uri,omitempty"`
+	Payload string `json:"payload"`
+}
+
+// Recorder writes entries as JSON lines
+type Recorder struct {
+	sync.Mutex
+	// Anonymize scrubs names, serial numbers and gateway details from
+	// payloads before they're written
+	Anonymize bool
+	enc       *json.Encoder
+}
+
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{
+		enc: json.NewEncoder(w),
+	}
+}
+
+func (r *Recorder) Write(e *Entry) error {
+	r.Lock()
+	defer r.Unlock()
+	if r.Anonymize {
+		e.Payload = string(Anonymize([]byte(e.Payload)))
+	}
+	return r.enc.Encode(e)
+}
+
+// Record captures everything published by and to the tradfri-mqtt instance
+// using prefix until the context is cancelled.
+func (r *Recorder) Record(ctx context.Context, mq mqtt.MQTT, prefix string) error {
+	rawCh := mq.SubscribeRaw(prefix + "-raw/#")
+	cmdCh := mq.SubscribeRaw(prefix + "-cmd")
+	replyCh := mq.SubscribeRaw(prefix + "-reply/#")
+
+	for {
+		var msg *mqtt.Packet
+		var open bool
+		var typ string
+		select {
+		case <-ctx.Done():
+			return nil
+		case msg, open = <-rawCh:
+			typ = TypeRaw
+		case msg, open = <-cmdCh:
+			typ = TypeCmd
+		case msg, open = <-replyCh:
+			typ = TypeReply
+		}
+		if !open {
+			return nil
+		}
+		e := &Entry{
+			Time:    time.Now(),
+			Gateway: prefix,
+			Type:    typ,
+			Topic:   msg.TopicName,
+			Payload: string(msg.Payload),
+		}
+		if typ == TypeRaw {
+			e.URI = strings.TrimPrefix(msg.TopicName, prefix+"-raw/")
+		}
+		if err := r.Write(e); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package replay
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"hemtjan.st/sladdlos/tradfri"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transport feeds a capture made by Recorder into a tree. Commands sent
+// to it are logged and dropped.
+type Transport struct {
+	sync.RWMutex
+	// Speed is how much faster than the original the capture is replayed,
+	// 0 replays as fast as possible
+	Speed   float64
+	entries []*Entry
+	state   map[string][]byte
+	tree    *tradfri.Tree
+}
+
+// Load reads a capture, only keeping the raw entries of gateway if set
+func Load(r io.Reader, gateway string) (*Transport, error) {
+	t := &Transport{
+		Speed: 1,
+		state: map[string][]byte{},
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		e := &Entry{}
+		if err := json.Unmarshal([]byte(line), e); err != nil {
+			return nil, err
+		}
+		if e.Type != TypeRaw || (gateway != "" && e.Gateway != gateway) {
+			continue
+		}
+		t.entries = append(t.entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *Transport) SetTree(tree *tradfri.Tree) {
+	t.Lock()
+	defer t.Unlock()
+	t.tree = tree
+}
+
+// Start replays the capture in the background
+func (t *Transport) Start(ctx context.Context) error {
+	go t.replay(ctx)
+	return nil
+}
+
+func (t *Transport) replay(ctx context.Context) {
+	var last time.Time
+	for _, e := range t.entries {
+		if !last.IsZero() && t.Speed > 0 {
+			delay := time.Duration(float64(e.Time.Sub(last)) / t.Speed)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+		}
+		last = e.Time
+		if ctx.Err() != nil {
+			return
+		}
+
+		t.Lock()
+		t.state[e.URI] = []byte(e.Payload)
+		tree := t.tree
+		t.Unlock()
+		if tree == nil {
+			continue
+		}
+		if err := tree.Populate(strings.Split(e.URI, "/"), []byte(e.Payload)); err != nil {
+			log.Print(err)
+			log.Printf("^- While replaying %s: %s", e.URI, e.Payload)
+		}
+	}
+	log.Printf("Replayed %d messages", len(t.entries))
+}
+
+func (t *Transport) Get(uri string) ([]byte, error) {
+	return t.GetContext(context.Background(), uri)
+}
+
+func (t *Transport) Put(uri string, data []byte) error {
+	return t.PutContext(context.Background(), uri, data)
+}
+
+func (t *Transport) Delete(uri string) error {
+	return t.DeleteContext(context.Background(), uri)
+}
+
+// GetContext returns the last replayed payload for uri
+func (t *Transport) GetContext(ctx context.Context, uri string) ([]byte, error) {
+	t.RLock()
+	defer t.RUnlock()
+	if data, ok := t.state[uri]; ok {
+		return data, nil
+	}
+	return nil, tradfri.ErrorFromCode("4.04")
+}
+
+func (t *Transport) PutContext(ctx context.Context, uri string, data []byte) error {
+	log.Printf("Replay: ignoring put to %s: %s", uri, string(data))
+	return nil
+}
+
+func (t *Transport) DeleteContext(ctx context.Context, uri string) error {
+	log.Printf("Replay: ignoring delete of %s", uri)
+	return nil
+}
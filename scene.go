@@ -0,0 +1,185 @@
+package sladdlos
+
+import (
+	"hemtjan.st/sladdlos/tradfri"
+	"lib.hemtjan.st/client"
+	"lib.hemtjan.st/device"
+	"lib.hemtjan.st/feature"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// HemtjanstScene is a scene of a group, announced as a switch that
+// activates it and is on while it's the active scene of the group
+type HemtjanstScene struct {
+	sync.RWMutex
+	client         *HemtjanstClient
+	Topic          string
+	group          *tradfri.Group
+	scene          *tradfri.Scene
+	device         client.Device
+	info           *device.Info
+	unobserve      func()
+	unobserveGroup func()
+	isRemoved      bool
+}
+
+func NewHemtjanstScene(client *HemtjanstClient, topic string, group *tradfri.Group, scene *tradfri.Scene) *HemtjanstScene {
+	h := &HemtjanstScene{
+		Topic:  topic,
+		client: client,
+		group:  group,
+		scene:  scene,
+	}
+	h.init()
+	return h
+}
+
+func (h *HemtjanstScene) buildInfo() *device.Info {
+	name := h.scene.Name
+	if h.group != nil && h.group.Name != "" {
+		name = h.group.Name + " " + name
+	}
+	return &device.Info{
+		Topic:        h.Topic,
+		Name:         name,
+		Manufacturer: "IKEA",
+		Model:        "Trådfri Scene",
+		SerialNumber: strconv.Itoa(h.scene.GetInstanceID()),
+		Type:         "switch",
+		Features: map[string]*feature.Info{
+			"on": {},
+		},
+	}
+}
+
+func (h *HemtjanstScene) init() {
+	h.Lock()
+	defer h.Unlock()
+	if h.client == nil || h.scene == nil {
+		return
+	}
+	if !h.client.SkipScene {
+		if !h.announce() {
+			return
+		}
+		log.Printf("[%s] Started", h.Topic)
+	}
+	h.unobserve = h.scene.Observe(h.onTradfriChange)
+	if h.group != nil {
+		h.unobserveGroup = h.group.Observe(h.onGroupChange)
+	}
+}
+
+// announce creates the device, must be called with the scene locked
+func (h *HemtjanstScene) announce() bool {
+	h.info = h.buildInfo()
+	var err error
+	h.device, err = client.NewDevice(h.info, h.client.transport)
+	if err != nil {
+		log.Printf("Error creating device: %s", err)
+		return false
+	}
+	_ = h.device.Feature("on").OnSetFunc(h.onSet)
+	h.publish()
+	return true
+}
+
+func (h *HemtjanstScene) onSet(newValue string) {
+	log.Printf("[%s] New suggested value for on: %s", h.Topic, newValue)
+	if newValue != "0" && strings.ToLower(newValue) != "false" && h.group != nil {
+		h.group.SetScene(h.scene.GetInstanceID())
+		return
+	}
+	// A scene can't be turned off, only replaced by another one
+	h.RLock()
+	defer h.RUnlock()
+	h.publish()
+}
+
+// publish must be called with the scene locked
+func (h *HemtjanstScene) publish() {
+	if h.device == nil || h.isRemoved {
+		return
+	}
+	val := "0"
+	if h.scene.IsActive.Bool() {
+		val = "1"
+	}
+	if err := h.device.Feature("on").Update(val); err != nil {
+		log.Printf("[%s] Error publishing on: %v", h.Topic, err)
+	}
+}
+
+func (h *HemtjanstScene) onTradfriChange(change []*tradfri.ObservedChange) {
+	for _, ch := range change {
+		if ch.Path != "" {
+			continue
+		}
+		switch ch.Field {
+		case "Name":
+			h.rename()
+			return
+		case "IsActive":
+			h.RLock()
+			h.publish()
+			h.RUnlock()
+		}
+	}
+}
+
+// onGroupChange announces the scene again if the group was renamed, as
+// that's part of the name of the device
+func (h *HemtjanstScene) onGroupChange(change []*tradfri.ObservedChange) {
+	for _, ch := range change {
+		if ch.Path == "" && ch.Field == "Name" {
+			h.rename()
+			return
+		}
+	}
+}
+
+// rename announces the scene again under its new name
+func (h *HemtjanstScene) rename() {
+	h.Lock()
+	defer h.Unlock()
+	if h.device == nil || h.isRemoved || h.buildInfo().Name == h.info.Name {
+		return
+	}
+	log.Printf("[%s] Name changed, announcing again", h.Topic)
+	if err := client.DeleteDevice(h.info, h.client.transport); err != nil {
+		log.Printf("[%s] Error removing device: %v", h.Topic, err)
+	}
+	h.device = nil
+	h.announce()
+}
+
+// Remove deletes the scene from Hemtjänst and stops reacting to changes
+// of it
+func (h *HemtjanstScene) Remove() {
+	h.Lock()
+	defer h.Unlock()
+	if h.isRemoved {
+		return
+	}
+	h.isRemoved = true
+	if h.unobserve != nil {
+		h.unobserve()
+		h.unobserve = nil
+	}
+	if h.unobserveGroup != nil {
+		h.unobserveGroup()
+		h.unobserveGroup = nil
+	}
+	if h.device == nil || h.info == nil {
+		return
+	}
+	if err := client.DeleteDevice(h.info, h.client.transport); err != nil {
+		log.Printf("[%s] Error removing device: %v", h.Topic, err)
+		return
+	}
+	h.device = nil
+	log.Printf("[%s] Removed", h.Topic)
+}
@@ -0,0 +1,31 @@
+package simulator
+
+// NewDemo returns a gateway with a small house worth of devices
+func NewDemo() *Gateway {
+	g := NewGateway()
+
+	kitchen1 := g.AddLight("Kitchen 1", "TRADFRI bulb E27 WS opal 980lm")
+	kitchen2 := g.AddLight("Kitchen 2", "TRADFRI bulb E27 WS opal 980lm")
+	living := g.AddLight("Living room", "TRADFRI bulb E27 CWS opal 600lm")
+	hallway := g.AddLight("Hallway", "TRADFRI bulb GU10 W 400lm")
+	plug := g.AddPlug("Coffee maker")
+	blind := g.AddBlind("Bedroom blind")
+	remote := g.AddRemote("Kitchen remote")
+	motion := g.AddMotionSensor("Hallway sensor")
+
+	kitchen := g.AddGroup("Kitchen", kitchen1, kitchen2, plug, remote)
+	g.AddGroup("Living room", living)
+	g.AddGroup("Hallway", hallway, motion)
+	g.AddGroup("Bedroom", blind)
+
+	g.AddScene(kitchen, "Everyday", map[int]map[string]interface{}{
+		kitchen1: {"5850": 1, "5851": 254, "5706": "f1e0b5"},
+		kitchen2: {"5850": 1, "5851": 254, "5706": "f1e0b5"},
+	})
+	g.AddScene(kitchen, "Relax", map[int]map[string]interface{}{
+		kitchen1: {"5850": 1, "5851": 80, "5706": "efd275"},
+		kitchen2: {"5850": 0},
+	})
+
+	return g
+}
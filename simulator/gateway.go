@@ -0,0 +1,658 @@
+package simulator
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/lucasb-eyer/go-colorful"
+	"hemtjan.st/sladdlos/tradfri"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	firstDeviceID = 65536
+	firstGroupID  = 131073
+	firstSceneID  = 196608
+)
+
+type resource = map[string]interface{}
+
+// Gateway is an in-process simulation of a Trådfri gateway. It implements
+// tradfri.ObservableTransport and produces the same JSON as the real one.
+type Gateway struct {
+	sync.Mutex
+	// BlindStep is how long a blind takes to move one percent
+	BlindStep time.Duration
+	resources map[string]resource
+	observers map[string][]*observer
+	listeners []func(uri string, data []byte)
+	blinds    map[int]int
+	nextID    map[string]int
+}
+
+func NewGateway() *Gateway {
+	g := &Gateway{
+		BlindStep: 250 * time.Millisecond,
+		resources: map[string]resource{},
+		observers: map[string][]*observer{},
+		blinds:    map[int]int{},
+		nextID: map[string]int{
+			tradfri.DeviceEndpoint: firstDeviceID,
+			tradfri.GroupEndpoint:  firstGroupID,
+			tradfri.SceneEndpoint:  firstSceneID,
+		},
+	}
+	g.resources[tradfri.GatewayEndpoint] = resource{
+		"9023": "pool.ntp.org",
+		"9029": "1.10.36",
+		"9035": "Simulated gateway",
+		"9054": 0,
+		"9059": time.Now().Unix(),
+		"9060": time.Now().UTC().Format("2006-01-02T15:04:05.000000Z"),
+		"9061": 0,
+		"9066": 0,
+		"9071": 1,
+	}
+	g.resources[tradfri.NotificationEndpoint] = nil
+	return g
+}
+
+// Listen calls cb with the uri and new JSON of every resource that changes
+func (g *Gateway) Listen(cb func(uri string, data []byte)) {
+	g.Lock()
+	defer g.Unlock()
+	g.listeners = append(g.listeners, cb)
+}
+
+// URIs returns the uri of every resource, including the lists
+func (g *Gateway) URIs() []string {
+	g.Lock()
+	defer g.Unlock()
+	uris := []string{tradfri.DeviceEndpoint, tradfri.GroupEndpoint, tradfri.SceneEndpoint}
+	for uri := range g.resources {
+		uris = append(uris, uri)
+	}
+	for _, id := range g.ids(tradfri.GroupEndpoint) {
+		uris = append(uris, tradfri.SceneEndpoint+"/"+strconv.Itoa(id))
+	}
+	sort.Strings(uris)
+	return uris
+}
+
+func (g *Gateway) newID(endpoint string) int {
+	id := g.nextID[endpoint]
+	g.nextID[endpoint]++
+	return id
+}
+
+func (g *Gateway) addDevice(name, model string, typ tradfri.DeviceType, power int, extra resource) int {
+	g.Lock()
+	id := g.newID(tradfri.DeviceEndpoint)
+	dev := resource{
+		"9001": name,
+		"9002": time.Now().Unix(),
+		"9003": id,
+		"9019": 1,
+		"9020": time.Now().Unix(),
+		"9054": 0,
+		"5750": int(typ),
+		"3": resource{
+			"0": "IKEA of Sweden",
+			"1": model,
+			"2": "",
+			"3": "2.3.050",
+			"6": power,
+		},
+	}
+	if power != 1 {
+		dev["3"].(resource)["9"] = 87
+	}
+	for k, v := range extra {
+		dev[k] = v
+	}
+	uri := tradfri.DeviceEndpoint + "/" + strconv.Itoa(id)
+	g.resources[uri] = dev
+	g.Unlock()
+	g.notify(uri, tradfri.DeviceEndpoint)
+	return id
+}
+
+// AddLight adds a bulb, a model containing " WS " gets color temperature
+// and " CWS " full color
+func (g *Gateway) AddLight(name, model string) int {
+	light := resource{"5850": 1, "5851": 254, "9003": 0}
+	if strings.Contains(model, " WS ") || strings.Contains(model, " CWS ") {
+		light["5706"] = tradfri.Normal
+		light["5709"] = 30140
+		light["5710"] = 26909
+		light["5711"] = 370
+	}
+	if strings.Contains(model, " CWS ") {
+		light["5707"] = 0
+		light["5708"] = 0
+	}
+	return g.addDevice(name, model, tradfri.TypeLight, 1, resource{"3311": []interface{}{light}})
+}
+
+func (g *Gateway) AddPlug(name string) int {
+	plug := resource{"5850": 0, "9003": 0}
+	return g.addDevice(name, "TRADFRI control outlet", tradfri.TypePlug, 1, resource{"3312": []interface{}{plug}})
+}
+
+func (g *Gateway) AddBlind(name string) int {
+	blind := resource{"5536": 0, "9003": 0}
+	return g.addDevice(name, "FYRTUR block-out roller blind", tradfri.TypeBlind, 3, resource{"15015": []interface{}{blind}})
+}
+
+func (g *Gateway) AddRemote(name string) int {
+	return g.addDevice(name, "TRADFRI remote control", tradfri.TypeRemote, 3, resource{"15009": []interface{}{resource{"9003": 0}}})
+}
+
+func (g *Gateway) AddMotionSensor(name string) int {
+	return g.addDevice(name, "TRADFRI motion sensor", tradfri.TypeMotionSensor, 3, resource{"3300": []interface{}{resource{"9003": 0}}})
+}
+
+// Motion simulates a motion sensor noticing movement, which like on the real
+// gateway only shows as the sensor being seen and its groups turning on
+func (g *Gateway) Motion(sensor int) {
+	g.Lock()
+	uri := tradfri.DeviceEndpoint + "/" + strconv.Itoa(sensor)
+	dev, ok := g.resources[uri]
+	if !ok {
+		g.Unlock()
+		return
+	}
+	dev["9020"] = time.Now().Unix()
+	changed := []string{uri}
+	for _, id := range g.ids(tradfri.GroupEndpoint) {
+		grpURI := tradfri.GroupEndpoint + "/" + strconv.Itoa(id)
+		grp := g.resources[grpURI]
+		for _, member := range groupMembers(grp) {
+			if member != sensor {
+				continue
+			}
+			on := resource{"5850": 1}
+			changed = append(changed, g.putGroup(strconv.Itoa(id), grp, on)...)
+			merge(grp, on)
+			changed = append(changed, grpURI)
+			break
+		}
+	}
+	g.Unlock()
+	g.notify(changed...)
+}
+
+func (g *Gateway) AddGroup(name string, members ...int) int {
+	g.Lock()
+	id := g.newID(tradfri.GroupEndpoint)
+	ids := make([]interface{}, len(members))
+	for i, m := range members {
+		ids[i] = m
+	}
+	uri := tradfri.GroupEndpoint + "/" + strconv.Itoa(id)
+	g.resources[uri] = resource{
+		"9001": name,
+		"9002": time.Now().Unix(),
+		"9003": id,
+		"5850": 1,
+		"5851": 254,
+		"9039": 0,
+		"9018": resource{"15002": resource{"9003": ids}},
+	}
+	g.Unlock()
+	g.notify(uri, tradfri.GroupEndpoint)
+	return id
+}
+
+// AddScene adds a scene to a group, settings are keyed by device id and
+// contain the light fields to apply, i.e. {"5850": 1, "5851": 100}
+func (g *Gateway) AddScene(group int, name string, settings map[int]map[string]interface{}) int {
+	g.Lock()
+	id := g.newID(tradfri.SceneEndpoint)
+	ls := []interface{}{}
+	for _, devID := range sortedKeys(settings) {
+		s := resource{"9003": devID}
+		for k, v := range settings[devID] {
+			s[k] = v
+		}
+		ls = append(ls, s)
+	}
+	grpURI := tradfri.SceneEndpoint + "/" + strconv.Itoa(group)
+	uri := grpURI + "/" + strconv.Itoa(id)
+	g.resources[uri] = resource{
+		"9001":  name,
+		"9002":  time.Now().Unix(),
+		"9003":  id,
+		"9057":  len(g.ids(grpURI)),
+		"9068":  0,
+		"9058":  0,
+		"9070":  0,
+		"15013": ls,
+	}
+	g.Unlock()
+	g.notify(uri, grpURI)
+	return id
+}
+
+func sortedKeys(m map[int]map[string]interface{}) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+// ids returns the sorted ids of the resources directly below uri
+func (g *Gateway) ids(uri string) []int {
+	ids := []int{}
+	depth := strings.Count(uri, "/") + 1
+	for k := range g.resources {
+		if !strings.HasPrefix(k, uri+"/") || strings.Count(k, "/") != depth {
+			continue
+		}
+		if id, err := strconv.Atoi(k[len(uri)+1:]); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func (g *Gateway) get(uri string) ([]byte, error) {
+	switch uri {
+	case tradfri.DeviceEndpoint, tradfri.GroupEndpoint:
+		return json.Marshal(g.ids(uri))
+	case tradfri.SceneEndpoint:
+		// The gateway lists the groups that have scenes
+		groups := []int{}
+		for _, id := range g.ids(tradfri.GroupEndpoint) {
+			if len(g.ids(tradfri.SceneEndpoint+"/"+strconv.Itoa(id))) > 0 {
+				groups = append(groups, id)
+			}
+		}
+		return json.Marshal(groups)
+	case tradfri.NotificationEndpoint:
+		return []byte("[]"), nil
+	}
+	if strings.HasPrefix(uri, tradfri.SceneEndpoint+"/") && strings.Count(uri, "/") == 1 {
+		if _, ok := g.resources[tradfri.GroupEndpoint+"/"+uri[len(tradfri.SceneEndpoint)+1:]]; ok {
+			return json.Marshal(g.ids(uri))
+		}
+	}
+	res, ok := g.resources[uri]
+	if !ok {
+		return nil, tradfri.ErrorFromCode("4.04")
+	}
+	return json.Marshal(res)
+}
+
+// notify sends the current state of every uri to observers and listeners,
+// must be called without the gateway locked
+func (g *Gateway) notify(uris ...string) {
+	for _, uri := range uris {
+		g.Lock()
+		data, err := g.get(uri)
+		if err != nil {
+			// Removed
+			data = []byte{}
+		}
+		observers := g.observers[uri]
+		listeners := g.listeners
+		g.Unlock()
+		for _, o := range observers {
+			o.callback(data)
+		}
+		for _, cb := range listeners {
+			cb(uri, data)
+		}
+	}
+}
+
+func (g *Gateway) Get(uri string) ([]byte, error) {
+	return g.GetContext(context.Background(), uri)
+}
+
+func (g *Gateway) Put(uri string, data []byte) error {
+	return g.PutContext(context.Background(), uri, data)
+}
+
+func (g *Gateway) Delete(uri string) error {
+	return g.DeleteContext(context.Background(), uri)
+}
+
+func (g *Gateway) GetContext(ctx context.Context, uri string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	g.Lock()
+	defer g.Unlock()
+	return g.get(uri)
+}
+
+func (g *Gateway) PutContext(ctx context.Context, uri string, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	changes := resource{}
+	if err := json.Unmarshal(data, &changes); err != nil {
+		return tradfri.ErrorFromCode("4.00")
+	}
+	g.Lock()
+	res, ok := g.resources[uri]
+	if !ok {
+		g.Unlock()
+		return tradfri.ErrorFromCode("4.04")
+	}
+	changed := []string{uri}
+	path := strings.Split(uri, "/")
+	switch path[0] {
+	case tradfri.DeviceEndpoint:
+		if id, err := strconv.Atoi(path[1]); err == nil {
+			g.putBlindPosition(id, res, changes)
+		}
+		putLightColor(res, changes)
+	case tradfri.GroupEndpoint:
+		changed = append(changed, g.putGroup(path[1], res, changes)...)
+	}
+	merge(res, changes)
+	g.Unlock()
+	g.notify(changed...)
+	return nil
+}
+
+func (g *Gateway) DeleteContext(ctx context.Context, uri string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	g.Lock()
+	if _, ok := g.resources[uri]; !ok || strings.Count(uri, "/") == 0 || uri == tradfri.GatewayEndpoint {
+		g.Unlock()
+		return tradfri.ErrorFromCode("4.04")
+	}
+	removed := []string{uri}
+	if strings.HasPrefix(uri, tradfri.GroupEndpoint+"/") {
+		sceneURI := tradfri.SceneEndpoint + uri[len(tradfri.GroupEndpoint):]
+		for _, id := range g.ids(sceneURI) {
+			s := sceneURI + "/" + strconv.Itoa(id)
+			delete(g.resources, s)
+			removed = append(removed, s)
+		}
+	}
+	delete(g.resources, uri)
+	g.Unlock()
+	g.notify(append(removed, uri[:strings.LastIndex(uri, "/")])...)
+	return nil
+}
+
+type observer struct {
+	callback func(data []byte)
+}
+
+// Observe calls callback with the current state of uri and then with every
+// change to it, an empty payload means it was removed
+func (g *Gateway) Observe(method, uri string, callback func(data []byte)) (func(), error) {
+	g.Lock()
+	data, err := g.get(uri)
+	if err != nil {
+		g.Unlock()
+		return nil, err
+	}
+	o := &observer{callback: callback}
+	g.observers[uri] = append(g.observers[uri], o)
+	g.Unlock()
+	callback(data)
+	return func() {
+		g.Lock()
+		defer g.Unlock()
+		g.observers[uri] = removeObserver(g.observers[uri], o)
+		if len(g.observers[uri]) == 0 {
+			delete(g.observers, uri)
+		}
+	}, nil
+}
+
+func removeObserver(observers []*observer, o *observer) []*observer {
+	for i, obs := range observers {
+		if obs == o {
+			return append(observers[:i:i], observers[i+1:]...)
+		}
+	}
+	return observers
+}
+
+// putGroup fans the on/dim state and scene of a group out to its members,
+// returning the uris of everything affected
+func (g *Gateway) putGroup(id string, grp resource, changes resource) []string {
+	var changed []string
+	light := resource{}
+	for _, k := range []string{"5850", "5851"} {
+		if v, ok := changes[k]; ok {
+			light[k] = v
+		}
+	}
+	if sceneID, ok := changes["9039"]; ok {
+		sceneURI := tradfri.SceneEndpoint + "/" + id
+		for _, sid := range g.ids(sceneURI) {
+			uri := sceneURI + "/" + strconv.Itoa(sid)
+			scene := g.resources[uri]
+			active := 0
+			if float64(sid) == toFloat(sceneID) {
+				active = 1
+				changed = append(changed, g.applyScene(scene)...)
+			}
+			if toFloat(scene["9058"]) != float64(active) {
+				scene["9058"] = active
+				changed = append(changed, uri)
+			}
+		}
+	}
+	if len(light) == 0 {
+		return changed
+	}
+	for _, member := range groupMembers(grp) {
+		uri := tradfri.DeviceEndpoint + "/" + strconv.Itoa(member)
+		dev, ok := g.resources[uri]
+		if !ok {
+			continue
+		}
+		if _, ok := dev["3311"]; ok {
+			merge(dev, resource{"3311": []interface{}{copyResource(light)}})
+		} else if on, ok := light["5850"]; ok {
+			if _, ok := dev["3312"]; ok {
+				merge(dev, resource{"3312": []interface{}{resource{"5850": on}}})
+			}
+		} else {
+			continue
+		}
+		changed = append(changed, uri)
+	}
+	return changed
+}
+
+func (g *Gateway) applyScene(scene resource) []string {
+	var changed []string
+	settings, _ := scene["15013"].([]interface{})
+	for _, s := range settings {
+		setting, ok := s.(resource)
+		if !ok {
+			continue
+		}
+		uri := tradfri.DeviceEndpoint + "/" + strconv.FormatFloat(toFloat(setting["9003"]), 'f', 0, 64)
+		dev, ok := g.resources[uri]
+		if !ok {
+			continue
+		}
+		light := copyResource(setting)
+		delete(light, "9003")
+		merge(dev, resource{"3311": []interface{}{light}})
+		changed = append(changed, uri)
+	}
+	return changed
+}
+
+// putLightColor adds xy to changes that set hue and saturation and the
+// other way around, like the gateway does for color bulbs
+func putLightColor(dev resource, changes resource) {
+	light := firstResource(changes, "3311")
+	current := firstResource(dev, "3311")
+	if light == nil || current == nil {
+		return
+	}
+	if _, ok := current["5707"]; !ok {
+		return
+	}
+	value := func(code string) int {
+		if v, ok := light[code]; ok {
+			return int(toFloat(v))
+		}
+		return int(toFloat(current[code]))
+	}
+	_, hue := light["5707"]
+	_, sat := light["5708"]
+	_, x := light["5709"]
+	_, y := light["5710"]
+	switch {
+	case hue || sat:
+		ls := &tradfri.LightSetting{Hue: value("5707"), Saturation: value("5708")}
+		h, s := ls.GetHueSat()
+		ls.SetColor(colorful.Hsv(h, s, 1))
+		light["5709"], light["5710"] = ls.ColorX, ls.ColorY
+	case x || y:
+		ls := &tradfri.LightSetting{ColorX: value("5709"), ColorY: value("5710")}
+		ls.SetHueSat(ls.GetHueSat())
+		light["5707"], light["5708"] = ls.Hue, ls.Saturation
+	}
+}
+
+// putBlindPosition removes a new position from changes and starts moving
+// the blind towards it
+func (g *Gateway) putBlindPosition(id int, dev resource, changes resource) {
+	blinds, ok := changes["15015"].([]interface{})
+	if !ok || len(blinds) == 0 {
+		return
+	}
+	blind, ok := blinds[0].(resource)
+	if !ok {
+		return
+	}
+	pos, ok := blind["5536"]
+	if !ok {
+		return
+	}
+	delete(blind, "5536")
+	_, moving := g.blinds[id]
+	g.blinds[id] = int(toFloat(pos))
+	if !moving {
+		go g.moveBlind(id, tradfri.DeviceEndpoint+"/"+strconv.Itoa(id))
+	}
+}
+
+func (g *Gateway) moveBlind(id int, uri string) {
+	for {
+		time.Sleep(g.BlindStep)
+		g.Lock()
+		dev, ok := g.resources[uri]
+		if !ok {
+			delete(g.blinds, id)
+			g.Unlock()
+			return
+		}
+		blind := firstResource(dev, "15015")
+		if blind == nil {
+			delete(g.blinds, id)
+			g.Unlock()
+			return
+		}
+		pos := int(toFloat(blind["5536"]))
+		target := g.blinds[id]
+		if pos < target {
+			pos++
+		} else if pos > target {
+			pos--
+		}
+		blind["5536"] = pos
+		done := pos == target
+		if done {
+			delete(g.blinds, id)
+		}
+		g.Unlock()
+		g.notify(uri)
+		if done {
+			return
+		}
+	}
+}
+
+func firstResource(r resource, key string) resource {
+	list, _ := r[key].([]interface{})
+	if len(list) == 0 {
+		return nil
+	}
+	first, _ := list[0].(resource)
+	return first
+}
+
+func groupMembers(grp resource) []int {
+	var ids []int
+	m, _ := grp["9018"].(resource)
+	acc, _ := m["15002"].(resource)
+	list, _ := acc["9003"].([]interface{})
+	for _, v := range list {
+		ids = append(ids, int(toFloat(v)))
+	}
+	return ids
+}
+
+// merge applies src onto dst, objects are merged recursively and arrays
+// of objects per index
+func merge(dst, src resource) {
+	for k, v := range src {
+		switch sv := v.(type) {
+		case resource:
+			if dv, ok := dst[k].(resource); ok {
+				merge(dv, sv)
+				continue
+			}
+			dst[k] = copyResource(sv)
+		case []interface{}:
+			dv, ok := dst[k].([]interface{})
+			if !ok || len(dv) != len(sv) {
+				dst[k] = sv
+				continue
+			}
+			for i := range sv {
+				dm, dok := dv[i].(resource)
+				sm, sok := sv[i].(resource)
+				if dok && sok {
+					merge(dm, sm)
+				} else {
+					dv[i] = sv[i]
+				}
+			}
+		default:
+			dst[k] = v
+		}
+	}
+}
+
+func copyResource(r resource) resource {
+	c := resource{}
+	merge(c, r)
+	return c
+}
+
+func toFloat(v interface{}) float64 {
+	switch n := v.(type) {
+	case float64:
+		return n
+	case int:
+		return float64(n)
+	case int64:
+		return float64(n)
+	}
+	return 0
+}
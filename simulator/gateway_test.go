@@ -0,0 +1,106 @@
+package simulator_test
+
+import (
+	"context"
+	"hemtjan.st/sladdlos/simulator"
+	"hemtjan.st/sladdlos/tradfri"
+	"testing"
+	"time"
+)
+
+// collect reads events until done returns true for the events seen so far
+func collect(t *testing.T, ctx context.Context, events <-chan *tradfri.Event, done func(seen []*tradfri.Event) bool) []*tradfri.Event {
+	t.Helper()
+	var seen []*tradfri.Event
+	for !done(seen) {
+		select {
+		case e := <-events:
+			seen = append(seen, e)
+		case <-ctx.Done():
+			t.Fatalf("Timed out after %d events", len(seen))
+		}
+	}
+	return seen
+}
+
+func count(seen []*tradfri.Event, typ tradfri.EventType, kind tradfri.EventKind) int {
+	n := 0
+	for _, e := range seen {
+		if e.Type == typ && e.Kind == kind {
+			n++
+		}
+	}
+	return n
+}
+
+// changed returns true if seen has a change of field for the accessory id
+func changed(seen []*tradfri.Event, id int, field string) bool {
+	for _, e := range seen {
+		if e.Type != tradfri.EventChanged || e.Kind != tradfri.KindAccessory || e.Accessory.GetInstanceID() != id {
+			continue
+		}
+		for _, ch := range e.Changes {
+			if ch.Field == field {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestDemo(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tree := tradfri.NewTree(simulator.NewDemo())
+	events := tree.Subscribe(ctx, nil)
+	if err := tree.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := collect(t, ctx, events, func(seen []*tradfri.Event) bool {
+		return count(seen, tradfri.EventAdded, tradfri.KindAccessory) == 8 &&
+			count(seen, tradfri.EventAdded, tradfri.KindGroup) == 4 &&
+			count(seen, tradfri.EventAdded, tradfri.KindScene) == 2
+	})
+	for _, e := range seen {
+		if e.Type == tradfri.EventAdded && e.Kind == tradfri.KindScene && e.Group.GetInstanceID() != 131073 {
+			t.Errorf("Scene %s added to group %d, expected the kitchen", e.Scene.Name, e.Group.GetInstanceID())
+		}
+	}
+
+	tree.RLock()
+	kitchen := tree.Groups[131073]
+	tree.RUnlock()
+	if kitchen == nil || kitchen.Name != "Kitchen" {
+		t.Fatalf("Expected the kitchen group, got %+v", kitchen)
+	}
+
+	// The bulbs are on and the outlet off, turning the group on and
+	// dimming it changes all of them but not the remote
+	kitchen.SetOn(true)
+	kitchen.SetDim(50)
+	if err := kitchen.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	collect(t, ctx, events, func(seen []*tradfri.Event) bool {
+		return changed(seen, 65536, "Dim") && changed(seen, 65537, "Dim") && changed(seen, 65540, "On")
+	})
+
+	// Relax turns the second kitchen bulb off
+	kitchen.SetScene(196609)
+	if err := kitchen.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	collect(t, ctx, events, func(seen []*tradfri.Event) bool {
+		return changed(seen, 65537, "On") && count(seen, tradfri.EventChanged, tradfri.KindScene) == 1
+	})
+	tree.RLock()
+	defer tree.RUnlock()
+	if l := tree.Devices[65537].Light(); l.IsOn() {
+		t.Error("Second kitchen bulb still on after activating Relax")
+	}
+	if !kitchen.Scenes[196609].IsActive.Bool() || kitchen.Scenes[196608].IsActive.Bool() {
+		t.Error("Expected Relax to be the only active scene")
+	}
+}
@@ -0,0 +1,106 @@
+package simulator
+
+import (
+	"context"
+	"encoding/json"
+	"hemtjan.st/sladdlos/tradfri"
+	"lib.hemtjan.st/transport/mqtt"
+	"log"
+	"strings"
+)
+
+type command struct {
+	Method     string          `json:"method"`
+	URL        string          `json:"url"`
+	ID         string          `json:"id,omitempty"`
+	ReplyTopic string          `json:"replyTopic,omitempty"`
+	Observe    bool            `json:"observe,omitempty"`
+	Payload    json.RawMessage `json:"payload"`
+}
+
+type reply struct {
+	ID      string          `json:"id"`
+	Code    string          `json:"code"`
+	Format  int             `json:"format"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// Serve publishes the gateway to MQTT the same way tradfri-mqtt does:
+// retained resources on <prefix>-raw/<uri>, commands read from <prefix>-cmd
+// and replies sent to the reply topic of each command.
+func (g *Gateway) Serve(ctx context.Context, mq mqtt.MQTT, prefix string) {
+	g.Listen(func(uri string, data []byte) {
+		mq.Publish(prefix+"-raw/"+uri, data, true)
+	})
+	for _, uri := range g.URIs() {
+		data, err := g.Get(uri)
+		if err != nil {
+			continue
+		}
+		mq.Publish(prefix+"-raw/"+uri, data, true)
+	}
+
+	cmdCh := mq.Subscribe(prefix + "-cmd")
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, open := <-cmdCh:
+			if !open {
+				return
+			}
+			go g.handle(ctx, mq, msg)
+		}
+	}
+}
+
+func (g *Gateway) handle(ctx context.Context, mq mqtt.MQTT, msg []byte) {
+	cmd := &command{}
+	if err := json.Unmarshal(msg, cmd); err != nil {
+		log.Printf("Invalid command: %v", err)
+		return
+	}
+	if cmd.Observe {
+		// Every change is published anyway
+		return
+	}
+
+	var payload []byte
+	var err error
+	code := "2.05"
+	switch strings.ToLower(cmd.Method) {
+	case "get":
+		payload, err = g.GetContext(ctx, cmd.URL)
+	case "put":
+		code = "2.04"
+		err = g.PutContext(ctx, cmd.URL, cmd.Payload)
+	case "delete":
+		code = "2.02"
+		err = g.DeleteContext(ctx, cmd.URL)
+	default:
+		code = "4.05"
+	}
+	if err != nil {
+		code = "5.00"
+		if e, ok := err.(*tradfri.Error); ok {
+			code = e.Code
+		}
+	}
+	log.Printf("%s %s: %s", cmd.Method, cmd.URL, code)
+
+	if cmd.ReplyTopic == "" {
+		return
+	}
+	if payload == nil {
+		payload = []byte("null")
+	}
+	js, err := json.Marshal(&reply{
+		ID:      cmd.ID,
+		Code:    code,
+		Payload: payload,
+	})
+	if err != nil {
+		return
+	}
+	mq.Publish(cmd.ReplyTopic, js, false)
+}
@@ -1,6 +1,7 @@
 package tradfri
 
 import (
+	"context"
 	"encoding/json"
 	"image/color"
 	"log"
@@ -11,6 +12,7 @@ import (
 type Accessory struct {
 	observable
 	pendingChanges *Accessory
+	flushTimer     *time.Timer
 	BaseType
 	Type       DeviceType  `json:"5750,omitempty"`
 	DeviceInfo *DeviceInfo `json:"3,omitempty"`
@@ -22,6 +24,9 @@ type Accessory struct {
 	Switches   []*Switch   `json:"15009,omitempty"`
 	Blinds     []*Blind    `json:"15015,omitempty"`
 	OTAUpdate  YesNo       `json:"9054,omitempty"`
+
+	// Extra holds the fields that are not known (yet), by IPSO code
+	Extra map[string]json.RawMessage `json:"-"`
 }
 
 func (a *Accessory) IsLight() bool {
@@ -40,6 +45,10 @@ func (a *Accessory) IsBlind() bool {
 	return a.Type == TypeBlind
 }
 
+func (a *Accessory) IsMotionSensor() bool {
+	return a.Type == TypeMotionSensor
+}
+
 func (a *Accessory) Plug() *Plug {
 	if len(a.Plugs) > 0 {
 		return a.Plugs[0]
@@ -54,6 +63,13 @@ func (a *Accessory) Light() *Light {
 	return nil
 }
 
+func (a *Accessory) Sensor() *Sensor {
+	if len(a.Sensors) > 0 {
+		return a.Sensors[0]
+	}
+	return nil
+}
+
 func (a *Accessory) Blind() *Blind {
 	if len(a.Blinds) > 0 {
 		return a.Blinds[0]
@@ -76,21 +92,9 @@ func (a *Accessory) update(cb func(ch *Accessory)) {
 		a.pendingChanges = &Accessory{
 			BaseType: BaseType{tree: a.tree},
 		}
-		time.AfterFunc(50*time.Millisecond, func() {
-			a.Lock()
-			defer a.Unlock()
-			a.pendingChanges.Lock()
-			defer a.pendingChanges.Unlock()
-			b, err := json.Marshal(a.pendingChanges)
-			a.pendingChanges = nil
-			if err != nil {
-				log.Printf("Error marshaling pending changes json: %v", err)
-				return
-			}
-			url := "15001/" + strconv.Itoa(a.GetInstanceID())
-			log.Printf("Sending to %s: %s", url, string(b))
-			if err := a.tree.transport.Put(url, b); err != nil {
-				log.Printf("Error sending data %s: %v", string(b), err)
+		a.flushTimer = time.AfterFunc(50*time.Millisecond, func() {
+			if err := a.Flush(context.Background()); err != nil {
+				log.Printf("Error sending changes of %d: %v", a.GetInstanceID(), err)
 			}
 		})
 	}
@@ -99,10 +103,34 @@ func (a *Accessory) update(cb func(ch *Accessory)) {
 	cb(a.pendingChanges)
 }
 
+// Flush sends the pending changes to the gateway right away instead of
+// shortly after the last one, and returns the error if that failed
+func (a *Accessory) Flush(ctx context.Context) error {
+	a.Lock()
+	defer a.Unlock()
+	if a.pendingChanges == nil {
+		return nil
+	}
+	if a.flushTimer != nil {
+		a.flushTimer.Stop()
+		a.flushTimer = nil
+	}
+	a.pendingChanges.Lock()
+	b, err := json.Marshal(a.pendingChanges)
+	a.pendingChanges.Unlock()
+	a.pendingChanges = nil
+	if err != nil {
+		return err
+	}
+	url := "15001/" + strconv.Itoa(a.GetInstanceID())
+	log.Printf("Sending to %s: %s", url, string(b))
+	return a.tree.put(ctx, a, url, b)
+}
+
 func (a *Accessory) updateDimmable(cb func(ch *Dimmable)) {
 	a.update(func(ch *Accessory) {
 		var l *Dimmable
-		if ch.IsLight() {
+		if ch.Light() != nil {
 			l = &ch.Light().Dimmable
 		} else {
 			li := &Light{}
@@ -116,9 +144,9 @@ func (a *Accessory) updateDimmable(cb func(ch *Dimmable)) {
 func (a *Accessory) updateOnOff(cb func(ch *OnOff)) {
 	a.update(func(ch *Accessory) {
 		var l *OnOff
-		if ch.IsLight() {
+		if ch.Light() != nil {
 			l = &ch.Light().OnOff
-		} else if ch.IsPlug() {
+		} else if ch.Plug() != nil {
 			l = &ch.Plug().OnOff
 		} else {
 			li := &Light{}
@@ -186,6 +214,27 @@ func (a *Accessory) SetColor(c color.Color) {
 	})
 }
 
+// SetTransitionTime makes the changes sent along with it fade over d
+// instead of the default of the gateway
+func (a *Accessory) SetTransitionTime(d time.Duration) {
+	if !a.IsLight() {
+		return
+	}
+	t := transitionTime(d)
+	a.updateLight(func(ch *Light) {
+		ch.TransitionTime = &t
+	})
+}
+
+func (a *Accessory) SetHueSat(hue, sat float64) {
+	if !a.IsLight() {
+		return
+	}
+	a.updateLight(func(ch *Light) {
+		ch.SetHueSat(hue, sat)
+	})
+}
+
 func (a *Accessory) SetColorTemp(c string) {
 	if !a.IsLight() {
 		return
@@ -195,6 +244,15 @@ func (a *Accessory) SetColorTemp(c string) {
 	})
 }
 
+func (a *Accessory) SetMireds(mireds int) {
+	if !a.IsLight() {
+		return
+	}
+	a.updateLight(func(ch *Light) {
+		ch.SetMireds(mireds)
+	})
+}
+
 func (a *Accessory) SetBlindPosition(pos int) {
 	if !a.IsBlind() {
 		return
@@ -6,7 +6,8 @@ import (
 
 type Blind struct {
 	BaseType
-	Position *int `json:"5536,omitempty"`
+	Position *int                       `json:"5536,omitempty"`
+	Extra    map[string]json.RawMessage `json:"-"`
 }
 
 func (b *Blind) Pos() int {
@@ -0,0 +1,157 @@
+package tradfri
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// store remembers the last payload of a resource so that the tree can be
+// saved, must be called with the tree locked
+func (t *Tree) store(path []string, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	uri := strings.Join(path, "/")
+	switch {
+	case uri == GatewayEndpoint, uri == NotificationEndpoint:
+	case path[0] == DeviceEndpoint && len(path) == 2:
+	case path[0] == GroupEndpoint && len(path) == 2:
+	case path[0] == SceneEndpoint && len(path) == 3:
+	default:
+		return
+	}
+	if bytes.Equal(t.state[uri], data) {
+		return
+	}
+	t.state[uri] = append([]byte{}, data...)
+	t.markChanged()
+}
+
+// forget must be called with the tree locked
+func (t *Tree) forget(uri string) {
+	if _, ok := t.state[uri]; !ok {
+		return
+	}
+	delete(t.state, uri)
+	t.markChanged()
+}
+
+func (t *Tree) markChanged() {
+	select {
+	case t.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Save writes the last known payload of every resource in the tree
+func (t *Tree) Save(w io.Writer) error {
+	t.RLock()
+	state := make(map[string]json.RawMessage, len(t.state))
+	for uri, data := range t.state {
+		state[uri] = data
+	}
+	t.RUnlock()
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(state)
+}
+
+// Load populates the tree with what was written by Save. Live data from
+// the gateway replaces it as it arrives.
+func (t *Tree) Load(r io.Reader) error {
+	state := map[string]json.RawMessage{}
+	if err := json.NewDecoder(r).Decode(&state); err != nil {
+		return err
+	}
+	uris := make([]string, 0, len(state))
+	for uri := range state {
+		uris = append(uris, uri)
+	}
+	sort.Slice(uris, func(i, j int) bool {
+		oi, oj := loadOrder(uris[i]), loadOrder(uris[j])
+		if oi != oj {
+			return oi < oj
+		}
+		return uris[i] < uris[j]
+	})
+	for _, uri := range uris {
+		if err := t.Populate(strings.Split(uri, "/"), state[uri]); err != nil {
+			log.Printf("Error loading %s from cache: %v", uri, err)
+		}
+	}
+	return nil
+}
+
+// loadOrder makes sure devices are loaded before the groups they're in,
+// and groups before their scenes
+func loadOrder(uri string) int {
+	for i, endpoint := range []string{DeviceEndpoint, GroupEndpoint, SceneEndpoint} {
+		if strings.HasPrefix(uri, endpoint+"/") {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// LoadFile loads the tree from a file written by SaveFile, a missing file
+// is not an error
+func (t *Tree) LoadFile(name string) error {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return t.Load(f)
+}
+
+// SaveFile saves the tree to a temporary file which then replaces name
+func (t *Tree) SaveFile(name string) error {
+	f, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	if err := t.Save(f); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// SaveOnChange saves the tree to name at most every interval when it has
+// changed, and once more when the context is cancelled
+func (t *Tree) SaveOnChange(ctx context.Context, name string, interval time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			if err := t.SaveFile(name); err != nil {
+				log.Printf("Error saving tree to %s: %v", name, err)
+			}
+			return
+		case <-t.changed:
+		}
+		if err := t.SaveFile(name); err != nil {
+			log.Printf("Error saving tree to %s: %v", name, err)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(interval):
+		}
+	}
+}
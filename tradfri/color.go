@@ -0,0 +1,66 @@
+package tradfri
+
+import (
+	"github.com/lucasb-eyer/go-colorful"
+	"math"
+)
+
+// hueScale and satScale are what the gateway uses for a full turn and
+// full saturation
+const (
+	hueScale = 65535.0 / 360
+	satScale = 65279.0
+)
+
+// gamut is the triangle of colors the color bulbs can make, in CIE xy
+var gamut = [3][2]float64{{0.68, 0.31}, {0.11, 0.82}, {0.13, 0.04}}
+
+// xyFromColor returns the chromaticity of c, moved to the closest color
+// in the gamut if it's outside of it
+func xyFromColor(c colorful.Color) (float64, float64) {
+	x, y, _ := c.Clamped().Xyy()
+	if inGamut(x, y) {
+		return x, y
+	}
+	bestX, bestY, best := x, y, math.Inf(1)
+	for i := range gamut {
+		px, py := closestOnEdge(gamut[i], gamut[(i+1)%len(gamut)], x, y)
+		if d := (px-x)*(px-x) + (py-y)*(py-y); d < best {
+			bestX, bestY, best = px, py, d
+		}
+	}
+	return bestX, bestY
+}
+
+func inGamut(x, y float64) bool {
+	side := func(a, b [2]float64) float64 {
+		return (b[0]-a[0])*(y-a[1]) - (b[1]-a[1])*(x-a[0])
+	}
+	d1, d2, d3 := side(gamut[0], gamut[1]), side(gamut[1], gamut[2]), side(gamut[2], gamut[0])
+	neg := d1 < 0 || d2 < 0 || d3 < 0
+	pos := d1 > 0 || d2 > 0 || d3 > 0
+	return !(neg && pos)
+}
+
+func closestOnEdge(a, b [2]float64, x, y float64) (float64, float64) {
+	dx, dy := b[0]-a[0], b[1]-a[1]
+	t := ((x-a[0])*dx + (y-a[1])*dy) / (dx*dx + dy*dy)
+	t = math.Max(0, math.Min(1, t))
+	return a[0] + t*dx, a[1] + t*dy
+}
+
+// colorFromXY returns the color with chromaticity x, y at brightness 0-1
+func colorFromXY(x, y, brightness float64) colorful.Color {
+	if y <= 0 {
+		return colorful.Hsv(0, 0, brightness)
+	}
+	r, g, b := colorful.XyzToLinearRgb(colorful.XyyToXyz(x, y, 1))
+	// As bright as it gets, brightness is applied below
+	m := math.Max(r, math.Max(g, b))
+	if m <= 0 {
+		return colorful.Hsv(0, 0, brightness)
+	}
+	c := colorful.LinearRgb(math.Max(0, r/m), math.Max(0, g/m), math.Max(0, b/m))
+	h, s, _ := c.Hsv()
+	return colorful.Hsv(h, s, brightness)
+}
@@ -1,16 +1,66 @@
 package tradfri
 
-import "strings"
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Power sources as in IPSO, except that IKEA reports mains powered
+// devices as having an internal battery
+const (
+	PowerInternalBattery = 1
+	PowerExternalBattery = 2
+	PowerBattery         = 3
+	PowerEthernet        = 4
+	PowerUSB             = 5
+	PowerMains           = 6
+	PowerSolar           = 7
+)
+
+// miredRanges are the coldest and warmest color temperatures of the white
+// spectrum models, anything else is taken to do the 250 to 454 mireds
+// (4000K to 2200K) of most IKEA bulbs
+var miredRanges = map[string][2]int{
+	"TRADFRI bulb E27 WS opal 980lm":   {250, 454},
+	"TRADFRI bulb E26 WS opal 980lm":   {250, 454},
+	"TRADFRI bulb E27 WS clear 950lm":  {250, 454},
+	"TRADFRI bulb E14 WS opal 400lm":   {250, 454},
+	"TRADFRI bulb E12 WS opal 400lm":   {250, 454},
+	"TRADFRI bulb GU10 WS 400lm":       {250, 454},
+	"TRADFRI bulb E27 WS globe 1055lm": {250, 454},
+	"FLOALT panel WS 30x30":            {250, 454},
+	"FLOALT panel WS 60x60":            {250, 454},
+	"FLOALT panel WS 30x90":            {250, 454},
+	// Philips Hue White Ambiance paired with the gateway
+	"LTW001": {153, 454},
+	"LTW004": {153, 454},
+	"LTW010": {153, 454},
+	"LTW012": {153, 454},
+	"LTW013": {153, 454},
+}
 
 type DeviceInfo struct {
-	Manufacturer string `json:"0"`
-	Model        string `json:"1"`
-	SerialNumber string `json:"2"`
-	Firmware     string `json:"3"`
-	Power        int    `json:"6"`
-	Battery      int    `json:"9"`
+	Manufacturer string                     `json:"0"`
+	Model        string                     `json:"1"`
+	SerialNumber string                     `json:"2"`
+	Firmware     string                     `json:"3"`
+	Power        int                        `json:"6"`
+	Battery      int                        `json:"9"`
+	Extra        map[string]json.RawMessage `json:"-"`
 }
 
 func (d *DeviceInfo) IsRGBModel() bool {
 	return strings.Contains(d.Model, " CWS ")
 }
+
+func (d *DeviceInfo) HasBattery() bool {
+	return d.Power == PowerBattery || d.Power == PowerExternalBattery
+}
+
+// MiredRange returns the coldest and warmest color temperature of the model
+func (d *DeviceInfo) MiredRange() (int, int) {
+	if r, ok := miredRanges[d.Model]; ok {
+		return r[0], r[1]
+	}
+	return coldMireds, warmMireds
+}
@@ -0,0 +1,419 @@
+package tradfri
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// The diff functions below are hand written versions of compare for the
+// types that get updated the most. They walk the fields in the same order,
+// report the same paths and values and update the old value in place just
+// like compare does. Fields added to these types have to be added here too.
+
+// differ is implemented by types with a hand written diff, n is always of
+// the same type as the receiver
+type differ interface {
+	diff(n interface{}) []*ObservedChange
+}
+
+type diffList []*ObservedChange
+
+func joinPath(path, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "/" + field
+}
+
+func (d *diffList) add(path, field string, o, n interface{}) {
+	*d = append(*d, &ObservedChange{
+		Path:     path,
+		Field:    field,
+		OldValue: o,
+		NewValue: n,
+	})
+}
+
+func (d *diffList) str(path, field string, o *string, n string) {
+	if *o != n {
+		d.add(path, field, *o, n)
+		*o = n
+	}
+}
+
+func (d *diffList) integer(path, field string, o *int, n int) {
+	if *o != n {
+		d.add(path, field, *o, n)
+		*o = n
+	}
+}
+
+func (d *diffList) integer64(path, field string, o *int64, n int64) {
+	if *o != n {
+		d.add(path, field, *o, n)
+		*o = n
+	}
+}
+
+func (d *diffList) yesNo(path, field string, o *YesNo, n YesNo) {
+	if *o != n {
+		d.add(path, field, *o, n)
+		*o = n
+	}
+}
+
+func (d *diffList) strPtr(path, field string, o **string, n *string) {
+	if (*o == nil) != (n == nil) || *o != nil && **o != *n {
+		d.add(path, field, *o, n)
+		*o = n
+	}
+}
+
+func (d *diffList) intPtr(path, field string, o **int, n *int) {
+	if (*o == nil) != (n == nil) || *o != nil && **o != *n {
+		d.add(path, field, *o, n)
+		*o = n
+	}
+}
+
+func (d *diffList) int64Ptr(path, field string, o **int64, n *int64) {
+	if (*o == nil) != (n == nil) || *o != nil && **o != *n {
+		d.add(path, field, *o, n)
+		*o = n
+	}
+}
+
+func (d *diffList) float64Ptr(path, field string, o **float64, n *float64) {
+	if (*o == nil) != (n == nil) || *o != nil && **o != *n {
+		d.add(path, field, *o, n)
+		*o = n
+	}
+}
+
+func (d *diffList) uint8Ptr(path, field string, o **uint8, n *uint8) {
+	if (*o == nil) != (n == nil) || *o != nil && **o != *n {
+		d.add(path, field, *o, n)
+		*o = n
+	}
+}
+
+func (d *diffList) yesNoPtr(path, field string, o **YesNo, n *YesNo) {
+	if (*o == nil) != (n == nil) || *o != nil && **o != *n {
+		d.add(path, field, *o, n)
+		*o = n
+	}
+}
+
+// ints compares like reflect.DeepEqual, where nil and empty differ
+func (d *diffList) ints(path, field string, o *[]int, n []int) {
+	equal := (*o == nil) == (n == nil) && len(*o) == len(n)
+	for i := 0; equal && i < len(n); i++ {
+		equal = (*o)[i] == n[i]
+	}
+	if !equal {
+		d.add(path, field, *o, n)
+		*o = n
+	}
+}
+
+func (d *diffList) extra(path string, o *map[string]json.RawMessage, n map[string]json.RawMessage) {
+	*d = append(*d, extraChanges(path, o, n)...)
+}
+
+// slice handles a slice of pointers being added, removed or changing length,
+// it returns false if there's nothing more to compare. The caller replaces
+// the old slice in that case and otherwise compares the elements.
+func (d *diffList) slice(path, field string, oNil, nNil bool, oLen, nLen int, o, n interface{}) bool {
+	switch {
+	case oNil && nNil:
+		return false
+	case nNil:
+		d.add(path, field, o, nil)
+		return false
+	case oNil:
+		d.add(path, field, nil, n)
+		return false
+	case oLen != nLen:
+		d.add(path, field, o, n)
+		return false
+	}
+	return true
+}
+
+func (d *diffList) baseType(path string, o, n *BaseType) {
+	d.str(path, "Name", &o.Name, n.Name)
+	d.integer64(path, "CreatedAt", &o.CreatedAt, n.CreatedAt)
+	d.integer(path, "InstanceID", &o.InstanceID, n.InstanceID)
+}
+
+func (d *diffList) dimmable(path string, o, n *Dimmable) {
+	d.yesNoPtr(path, "On", &o.On, n.On)
+	d.uint8Ptr(path, "Dim", &o.Dim, n.Dim)
+}
+
+func (d *diffList) lightSetting(path string, o, n *LightSetting) {
+	d.lightSettingFields(path, o, n)
+	d.extra(path, &o.Extra, n.Extra)
+}
+
+// lightSettingFields compares everything but Extra, which a Light shadows
+// with its own
+func (d *diffList) lightSettingFields(path string, o, n *LightSetting) {
+	d.baseType(path, &o.BaseType, &n.BaseType)
+	d.dimmable(path, &o.Dimmable, &n.Dimmable)
+	d.str(path, "Color", &o.Color, n.Color)
+	d.integer(path, "Hue", &o.Hue, n.Hue)
+	d.integer(path, "Saturation", &o.Saturation, n.Saturation)
+	d.integer(path, "ColorX", &o.ColorX, n.ColorX)
+	d.integer(path, "ColorY", &o.ColorY, n.ColorY)
+	d.integer(path, "Mireds", &o.Mireds, n.Mireds)
+}
+
+func (d *diffList) lightSettingPtr(path, field string, o **LightSetting, n *LightSetting) {
+	if *o == nil && n == nil {
+		return
+	}
+	if n == nil {
+		d.add(path, field, *o, nil)
+		*o = nil
+		return
+	}
+	if *o == nil {
+		*o = &LightSetting{}
+	}
+	d.lightSetting(joinPath(path, field), *o, n)
+}
+
+func (d *diffList) lightPtr(path, field string, o **Light, n *Light) {
+	if *o == nil && n == nil {
+		return
+	}
+	if n == nil {
+		d.add(path, field, *o, nil)
+		*o = nil
+		return
+	}
+	if *o == nil {
+		*o = &Light{}
+	}
+	path = joinPath(path, field)
+	// compare goes through the fields of the embedded LightSetting first,
+	// where Extra resolves to the one of the Light
+	d.lightSettingFields(path, &(*o).LightSetting, &n.LightSetting)
+	d.extra(path, &(*o).Extra, n.Extra)
+	d.intPtr(path, "TransitionTime", &(*o).TransitionTime, n.TransitionTime)
+	d.float64Ptr(path, "CumulativeActivePower", &(*o).CumulativeActivePower, n.CumulativeActivePower)
+	d.int64Ptr(path, "OnTime", &(*o).OnTime, n.OnTime)
+	d.float64Ptr(path, "PowerFactor", &(*o).PowerFactor, n.PowerFactor)
+	d.strPtr(path, "Unit", &(*o).Unit, n.Unit)
+}
+
+func (d *diffList) plugPtr(path, field string, o **Plug, n *Plug) {
+	if *o == nil && n == nil {
+		return
+	}
+	if n == nil {
+		d.add(path, field, *o, nil)
+		*o = nil
+		return
+	}
+	if *o == nil {
+		*o = &Plug{}
+	}
+	path = joinPath(path, field)
+	d.baseType(path, &(*o).BaseType, &n.BaseType)
+	d.yesNoPtr(path, "On", &(*o).On, n.On)
+	d.float64Ptr(path, "ActivePower", &(*o).ActivePower, n.ActivePower)
+	d.float64Ptr(path, "CumulativeActivePower", &(*o).CumulativeActivePower, n.CumulativeActivePower)
+	d.float64Ptr(path, "PowerFactor", &(*o).PowerFactor, n.PowerFactor)
+	d.int64Ptr(path, "OnTime", &(*o).OnTime, n.OnTime)
+	d.strPtr(path, "Unit", &(*o).Unit, n.Unit)
+	d.extra(path, &(*o).Extra, n.Extra)
+}
+
+func (d *diffList) sensorPtr(path, field string, o **Sensor, n *Sensor) {
+	if *o == nil && n == nil {
+		return
+	}
+	if n == nil {
+		d.add(path, field, *o, nil)
+		*o = nil
+		return
+	}
+	if *o == nil {
+		*o = &Sensor{}
+	}
+	path = joinPath(path, field)
+	d.baseType(path, &(*o).BaseType, &n.BaseType)
+	d.float64Ptr(path, "Value", &(*o).Value, n.Value)
+	d.strPtr(path, "Unit", &(*o).Unit, n.Unit)
+	d.float64Ptr(path, "MinMeasured", &(*o).MinMeasured, n.MinMeasured)
+	d.float64Ptr(path, "MaxMeasured", &(*o).MaxMeasured, n.MaxMeasured)
+	d.float64Ptr(path, "MinRange", &(*o).MinRange, n.MinRange)
+	d.float64Ptr(path, "MaxRange", &(*o).MaxRange, n.MaxRange)
+	d.extra(path, &(*o).Extra, n.Extra)
+}
+
+func (d *diffList) switchPtr(path, field string, o **Switch, n *Switch) {
+	if *o == nil && n == nil {
+		return
+	}
+	if n == nil {
+		d.add(path, field, *o, nil)
+		*o = nil
+		return
+	}
+	if *o == nil {
+		*o = &Switch{}
+	}
+	path = joinPath(path, field)
+	d.baseType(path, &(*o).BaseType, &n.BaseType)
+	d.extra(path, &(*o).Extra, n.Extra)
+}
+
+func (d *diffList) blindPtr(path, field string, o **Blind, n *Blind) {
+	if *o == nil && n == nil {
+		return
+	}
+	if n == nil {
+		d.add(path, field, *o, nil)
+		*o = nil
+		return
+	}
+	if *o == nil {
+		*o = &Blind{}
+	}
+	path = joinPath(path, field)
+	d.baseType(path, &(*o).BaseType, &n.BaseType)
+	d.intPtr(path, "Position", &(*o).Position, n.Position)
+	d.extra(path, &(*o).Extra, n.Extra)
+}
+
+func (d *diffList) deviceInfoPtr(path, field string, o **DeviceInfo, n *DeviceInfo) {
+	if *o == nil && n == nil {
+		return
+	}
+	if n == nil {
+		d.add(path, field, *o, nil)
+		*o = nil
+		return
+	}
+	if *o == nil {
+		*o = &DeviceInfo{}
+	}
+	path = joinPath(path, field)
+	d.str(path, "Manufacturer", &(*o).Manufacturer, n.Manufacturer)
+	d.str(path, "Model", &(*o).Model, n.Model)
+	d.str(path, "SerialNumber", &(*o).SerialNumber, n.SerialNumber)
+	d.str(path, "Firmware", &(*o).Firmware, n.Firmware)
+	d.integer(path, "Power", &(*o).Power, n.Power)
+	d.integer(path, "Battery", &(*o).Battery, n.Battery)
+	d.extra(path, &(*o).Extra, n.Extra)
+}
+
+func (a *Accessory) diff(v interface{}) []*ObservedChange {
+	n := v.(*Accessory)
+	d := diffList{}
+	d.baseType("", &a.BaseType, &n.BaseType)
+	if a.Type != n.Type {
+		d.add("", "Type", a.Type, n.Type)
+		a.Type = n.Type
+	}
+	d.deviceInfoPtr("", "DeviceInfo", &a.DeviceInfo, n.DeviceInfo)
+	d.yesNo("", "Alive", &a.Alive, n.Alive)
+	d.integer64("", "LastSeen", &a.LastSeen, n.LastSeen)
+
+	if d.slice("", "Lights", a.Lights == nil, n.Lights == nil, len(a.Lights), len(n.Lights), a.Lights, n.Lights) {
+		for i := range n.Lights {
+			d.lightPtr("Lights", strconv.Itoa(i), &a.Lights[i], n.Lights[i])
+		}
+	} else {
+		a.Lights = n.Lights
+	}
+	if d.slice("", "Plugs", a.Plugs == nil, n.Plugs == nil, len(a.Plugs), len(n.Plugs), a.Plugs, n.Plugs) {
+		for i := range n.Plugs {
+			d.plugPtr("Plugs", strconv.Itoa(i), &a.Plugs[i], n.Plugs[i])
+		}
+	} else {
+		a.Plugs = n.Plugs
+	}
+	if d.slice("", "Sensors", a.Sensors == nil, n.Sensors == nil, len(a.Sensors), len(n.Sensors), a.Sensors, n.Sensors) {
+		for i := range n.Sensors {
+			d.sensorPtr("Sensors", strconv.Itoa(i), &a.Sensors[i], n.Sensors[i])
+		}
+	} else {
+		a.Sensors = n.Sensors
+	}
+	if d.slice("", "Switches", a.Switches == nil, n.Switches == nil, len(a.Switches), len(n.Switches), a.Switches, n.Switches) {
+		for i := range n.Switches {
+			d.switchPtr("Switches", strconv.Itoa(i), &a.Switches[i], n.Switches[i])
+		}
+	} else {
+		a.Switches = n.Switches
+	}
+	if d.slice("", "Blinds", a.Blinds == nil, n.Blinds == nil, len(a.Blinds), len(n.Blinds), a.Blinds, n.Blinds) {
+		for i := range n.Blinds {
+			d.blindPtr("Blinds", strconv.Itoa(i), &a.Blinds[i], n.Blinds[i])
+		}
+	} else {
+		a.Blinds = n.Blinds
+	}
+
+	d.yesNo("", "OTAUpdate", &a.OTAUpdate, n.OTAUpdate)
+	d.extra("", &a.Extra, n.Extra)
+	return d
+}
+
+func (g *Group) diff(v interface{}) []*ObservedChange {
+	n := v.(*Group)
+	d := diffList{}
+	d.baseType("", &g.BaseType, &n.BaseType)
+	d.dimmable("", &g.Dimmable, &n.Dimmable)
+	d.intPtr("", "Scene", &g.Scene, n.Scene)
+	d.ints("", "Members", &g.Members, n.Members)
+	d.intPtr("", "TransitionTime", &g.TransitionTime, n.TransitionTime)
+	d.extra("", &g.Extra, n.Extra)
+	return d
+}
+
+func (s *Scene) diff(v interface{}) []*ObservedChange {
+	n := v.(*Scene)
+	d := diffList{}
+	d.baseType("", &s.BaseType, &n.BaseType)
+	d.integer("", "Index", &s.Index, n.Index)
+	d.yesNo("", "IsPredefined", &s.IsPredefined, n.IsPredefined)
+	d.yesNo("", "IsActive", &s.IsActive, n.IsActive)
+	if d.slice("", "LightSettings", s.LightSettings == nil, n.LightSettings == nil, len(s.LightSettings), len(n.LightSettings), s.LightSettings, n.LightSettings) {
+		for i := range n.LightSettings {
+			d.lightSettingPtr("LightSettings", strconv.Itoa(i), &s.LightSettings[i], n.LightSettings[i])
+		}
+	} else {
+		s.LightSettings = n.LightSettings
+	}
+	d.yesNo("", "UseCurrentLightSettings", &s.UseCurrentLightSettings, n.UseCurrentLightSettings)
+	d.extra("", &s.Extra, n.Extra)
+	return d
+}
+
+func (g *Gateway) diff(v interface{}) []*ObservedChange {
+	n := v.(*Gateway)
+	d := diffList{}
+	d.str("", "NTPServer", &g.NTPServer, n.NTPServer)
+	d.str("", "Version", &g.Version, n.Version)
+	d.integer("", "UpdateState", &g.UpdateState, n.UpdateState)
+	d.integer("", "UpdateProgress", &g.UpdateProgress, n.UpdateProgress)
+	d.str("", "UpdateURL", &g.UpdateURL, n.UpdateURL)
+	d.integer64("", "Timestamp", &g.Timestamp, n.Timestamp)
+	d.str("", "TimestampUtc", &g.TimestampUtc, n.TimestampUtc)
+	d.integer("", "CommissioningMode", &g.CommissioningMode, n.CommissioningMode)
+	if g.UpdatePriority != n.UpdatePriority {
+		d.add("", "UpdatePriority", g.UpdatePriority, n.UpdatePriority)
+		g.UpdatePriority = n.UpdatePriority
+	}
+	d.integer64("", "UpdateAcceptedTimestamp", &g.UpdateAcceptedTimestamp, n.UpdateAcceptedTimestamp)
+	d.integer("", "TimeSource", &g.TimeSource, n.TimeSource)
+	d.str("", "ForceCheckOTAUpdate", &g.ForceCheckOTAUpdate, n.ForceCheckOTAUpdate)
+	d.str("", "Name", &g.Name, n.Name)
+	d.extra("", &g.Extra, n.Extra)
+	return d
+}
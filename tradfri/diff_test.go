@@ -0,0 +1,186 @@
+package tradfri
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// diffCases are payloads as sent by a gateway, before and after a change
+var diffCases = []struct {
+	name     string
+	new      func() interface{}
+	old, cur string
+}{
+	{
+		name: "bulb dimmed",
+		new:  func() interface{} { return &Accessory{} },
+		old:  `{"9001":"Kitchen 1","9002":1546300800,"9003":65536,"9019":1,"9020":1571000000,"9054":0,"5750":2,"3":{"0":"IKEA of Sweden","1":"TRADFRI bulb E27 WS opal 980lm","2":"","3":"2.3.050","6":1},"3311":[{"5850":1,"5851":254,"5711":370,"5709":30140,"5710":26909,"5706":"f1e0b5","5717":0,"9003":0}]}`,
+		cur:  `{"9001":"Kitchen 1","9002":1546300800,"9003":65536,"9019":1,"9020":1571000060,"9054":0,"5750":2,"3":{"0":"IKEA of Sweden","1":"TRADFRI bulb E27 WS opal 980lm","2":"","3":"2.3.050","6":1},"3311":[{"5850":1,"5851":80,"5711":454,"5709":33135,"5710":27211,"5706":"efd275","5712":10,"5717":2,"5849":1,"9003":0}]}`,
+	},
+	{
+		name: "bulb turned off",
+		new:  func() interface{} { return &Accessory{} },
+		old:  `{"9001":"Living room","9002":1546300800,"9003":65538,"9019":1,"9020":1571000000,"5750":2,"3":{"0":"IKEA of Sweden","1":"TRADFRI bulb E27 CWS opal 600lm","2":"","3":"1.3.002","6":1},"3311":[{"5850":1,"5851":200,"5707":5427,"5708":50352,"5709":42596,"5710":19634,"5706":"e78834","9003":0}]}`,
+		cur:  `{"9001":"Living room","9002":1546300800,"9003":65538,"9019":1,"9020":1571000010,"5750":2,"3":{"0":"IKEA of Sweden","1":"TRADFRI bulb E27 CWS opal 600lm","2":"","3":"1.3.002","6":1},"3311":[{"5850":0,"5851":200,"5707":5427,"5708":50352,"5709":42596,"5710":19634,"5706":"e78834","9003":0}]}`,
+	},
+	{
+		name: "bulb unreachable",
+		new:  func() interface{} { return &Accessory{} },
+		old:  `{"9001":"Hallway","9003":65539,"9019":1,"9020":1571000000,"5750":2,"3":{"0":"IKEA of Sweden","1":"TRADFRI bulb GU10 W 400lm","3":"1.2.214","6":1},"3311":[{"5850":1,"5851":254,"9003":0}]}`,
+		cur:  `{"9001":"Hallway","9003":65539,"9019":0,"9020":1571000000,"5750":2,"3":{"0":"IKEA of Sweden","1":"TRADFRI bulb GU10 W 400lm","3":"1.2.214","6":1}}`,
+	},
+	{
+		name: "plug",
+		new:  func() interface{} { return &Accessory{} },
+		old:  `{"9001":"Coffee maker","9003":65540,"9019":1,"9020":1571000000,"5750":3,"3":{"0":"IKEA of Sweden","1":"TRADFRI control outlet","3":"2.0.024","6":1},"3312":[{"5850":0,"9003":0}]}`,
+		cur:  `{"9001":"Coffee maker","9003":65540,"9019":1,"9020":1571000030,"5750":3,"3":{"0":"IKEA of Sweden","1":"TRADFRI control outlet","3":"2.0.024","6":1},"3312":[{"5850":1,"5805":12.5,"9003":0}]}`,
+	},
+	{
+		name: "blind",
+		new:  func() interface{} { return &Accessory{} },
+		old:  `{"9001":"Bedroom blind","9003":65541,"9019":1,"9020":1571000000,"5750":7,"3":{"0":"IKEA of Sweden","1":"FYRTUR block-out roller blind","3":"2.2.007","6":3,"9":87},"15015":[{"5536":0.0,"9003":0}]}`,
+		cur:  `{"9001":"Bedroom blind","9003":65541,"9019":1,"9020":1571000300,"5750":7,"3":{"0":"IKEA of Sweden","1":"FYRTUR block-out roller blind","3":"2.2.007","6":3,"9":86},"15015":[{"5536":100.0,"9003":0}]}`,
+	},
+	{
+		name: "remote heartbeat",
+		new:  func() interface{} { return &Accessory{} },
+		old:  `{"9001":"Kitchen remote","9003":65542,"9019":1,"9020":1571000000,"5750":0,"3":{"0":"IKEA of Sweden","1":"TRADFRI remote control","3":"2.3.014","6":3,"9":74},"15009":[{"9003":0}]}`,
+		cur:  `{"9001":"Kitchen remote","9003":65542,"9019":1,"9020":1571003600,"5750":0,"3":{"0":"IKEA of Sweden","1":"TRADFRI remote control","3":"2.3.014","6":3,"9":73},"15009":[{"9003":0}],"9084":" 7f 1a 2b"}`,
+	},
+	{
+		name: "motion sensor",
+		new:  func() interface{} { return &Accessory{} },
+		old:  `{"9001":"Hallway sensor","9003":65543,"9019":1,"9020":1571000000,"5750":4,"3":{"0":"IKEA of Sweden","1":"TRADFRI motion sensor","3":"2.0.022","6":3,"9":90},"3300":[{"9003":0}]}`,
+		cur:  `{"9001":"Hallway sensor","9003":65543,"9019":1,"9020":1571000020,"5750":4,"3":{"0":"IKEA of Sweden","1":"TRADFRI motion sensor","3":"2.0.022","6":3,"9":90},"3300":[{"9003":0,"5700":1.0}]}`,
+	},
+	{
+		name: "group turned on",
+		new:  func() interface{} { return &Group{} },
+		old:  `{"9001":"Kitchen","9002":1546300800,"9003":131073,"5850":0,"5851":0,"9039":196608,"9108":0,"9018":{"15002":{"9003":[65536,65537,65540,65542]}}}`,
+		cur:  `{"9001":"Kitchen","9002":1546300800,"9003":131073,"5850":1,"5851":127,"9039":196609,"9108":0,"9018":{"15002":{"9003":[65536,65537,65540,65542]}}}`,
+	},
+	{
+		name: "group members",
+		new:  func() interface{} { return &Group{} },
+		old:  `{"9001":"Hallway","9003":131075,"5850":1,"5851":254,"9039":196610,"9018":{"15002":{"9003":[65539]}}}`,
+		cur:  `{"9001":"Hall","9003":131075,"5850":1,"5851":254,"9039":196610,"5712":10,"9018":{"15002":{"9003":[65539,65543]}}}`,
+	},
+	{
+		name: "scene activated",
+		new:  func() interface{} { return &Scene{} },
+		old:  `{"9001":"Relax","9002":1546300800,"9003":196609,"9057":1,"9068":1,"9058":0,"9109":0,"15013":[{"5850":1,"5851":80,"5706":"efd275","9003":65536},{"5850":0,"9003":65537}]}`,
+		cur:  `{"9001":"Relax","9002":1546300800,"9003":196609,"9057":1,"9068":1,"9058":1,"9109":0,"15013":[{"5850":1,"5851":100,"5706":"efd275","9003":65536},{"5850":0,"9003":65537},{"5850":1,"9003":65540}]}`,
+	},
+	{
+		name: "scene light settings",
+		new:  func() interface{} { return &Scene{} },
+		old:  `{"9001":"Everyday","9003":196608,"9058":1,"15013":[{"5850":1,"5851":254,"5706":"f1e0b5","9003":65536},{"5850":1,"5851":254,"5706":"f1e0b5","9003":65537}]}`,
+		cur:  `{"9001":"Everyday","9003":196608,"9058":0,"15013":[{"5850":1,"5851":200,"5706":"f5faf6","5711":250,"5717":0,"9003":65536},{"5850":1,"5851":254,"5706":"f1e0b5","9003":65537}]}`,
+	},
+	{
+		name: "gateway",
+		new:  func() interface{} { return &Gateway{} },
+		old:  `{"9023":"xyz.pool.ntp.org","9029":"1.9.27","9054":0,"9055":0,"9056":"","9059":1571000000,"9060":"2019-10-13T21:33:20.000Z","9061":0,"9066":5,"9069":0,"9071":1,"9032":"","9035":"Home","9062":0,"9072":1}`,
+		cur:  `{"9023":"xyz.pool.ntp.org","9029":"1.10.32","9054":1,"9055":34,"9056":"http://fw.ota.homesmart.ikea.net/feed/version_info.json","9059":1571000600,"9060":"2019-10-13T21:43:20.000Z","9061":0,"9066":1,"9069":1571000500,"9071":1,"9032":"","9035":"Home","9062":1,"9073":0}`,
+	},
+}
+
+func decoded(t testing.TB, new func() interface{}, data string) interface{} {
+	t.Helper()
+	v := new()
+	if err := decode([]byte(data), v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// TestDiff replays the payloads through both the hand written diff and
+// compare, which have to report the same changes and end up the same
+func TestDiff(t *testing.T) {
+	for _, c := range diffCases {
+		t.Run(c.name, func(t *testing.T) {
+			typed, reflected := decoded(t, c.new, c.old), decoded(t, c.new, c.old)
+			got := typed.(differ).diff(decoded(t, c.new, c.cur))
+			want := compare(reflect.ValueOf(reflected), reflect.ValueOf(decoded(t, c.new, c.cur)), "")
+			if len(want) == 0 {
+				t.Fatal("No changes, the case doesn't test anything")
+			}
+			if !reflect.DeepEqual([]*ObservedChange(got), want) {
+				t.Errorf("diff and compare disagree\ndiff:    %v\ncompare: %v", got, want)
+			}
+			if !reflect.DeepEqual(typed, reflected) {
+				t.Errorf("diff and compare updated differently\ndiff:    %+v\ncompare: %+v", typed, reflected)
+			}
+		})
+	}
+}
+
+// benchmarkDiff runs the cases of a type through both engines, with a
+// freshly decoded old value for every round as both update it in place
+func benchmarkDiff(b *testing.B, kind string) {
+	var cases []int
+	for i, c := range diffCases {
+		if reflect.TypeOf(c.new()).Elem().Name() == kind {
+			cases = append(cases, i)
+		}
+	}
+	engines := []struct {
+		name string
+		run  func(o, n interface{})
+	}{
+		{"diff", func(o, n interface{}) { o.(differ).diff(n) }},
+		{"compare", func(o, n interface{}) { compare(reflect.ValueOf(o), reflect.ValueOf(n), "") }},
+	}
+	for _, e := range engines {
+		b.Run(e.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				c := diffCases[cases[i%len(cases)]]
+				b.StopTimer()
+				o, n := decoded(b, c.new, c.old), decoded(b, c.new, c.cur)
+				b.StartTimer()
+				e.run(o, n)
+			}
+		})
+	}
+}
+
+func BenchmarkDiffAccessory(b *testing.B) { benchmarkDiff(b, "Accessory") }
+func BenchmarkDiffGroup(b *testing.B)     { benchmarkDiff(b, "Group") }
+func BenchmarkDiffScene(b *testing.B)     { benchmarkDiff(b, "Scene") }
+func BenchmarkDiffGateway(b *testing.B)   { benchmarkDiff(b, "Gateway") }
+
+// benchmarkDecode compares decode, which also fills Extra, with a plain
+// json.Unmarshal of the cases of a type
+func benchmarkDecode(b *testing.B, kind string) {
+	var cases []int
+	for i, c := range diffCases {
+		if reflect.TypeOf(c.new()).Elem().Name() == kind {
+			cases = append(cases, i)
+		}
+	}
+	decoders := []struct {
+		name string
+		run  func(data []byte, v interface{}) error
+	}{
+		{"unmarshal", json.Unmarshal},
+		{"decode", decode},
+	}
+	for _, d := range decoders {
+		b.Run(d.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				c := diffCases[cases[i%len(cases)]]
+				if err := d.run([]byte(c.cur), c.new()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDecodeAccessory(b *testing.B) { benchmarkDecode(b, "Accessory") }
+func BenchmarkDecodeGroup(b *testing.B)     { benchmarkDecode(b, "Group") }
+func BenchmarkDecodeScene(b *testing.B)     { benchmarkDecode(b, "Scene") }
+func BenchmarkDecodeGateway(b *testing.B)   { benchmarkDecode(b, "Gateway") }
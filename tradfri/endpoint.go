@@ -1,5 +1,7 @@
 package tradfri
 
+import "time"
+
 const (
 	DeviceEndpoint       = "15001"
 	GroupEndpoint        = "15004"
@@ -7,3 +9,6 @@ const (
 	NotificationEndpoint = "15006"
 	GatewayEndpoint      = "15011/15012"
 )
+
+// requestTimeout is used for requests made by the tree itself
+const requestTimeout = 10 * time.Second
@@ -0,0 +1,85 @@
+package tradfri
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrBadRequest   = errors.New("bad request")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrNotFound     = errors.New("not found")
+	ErrGateway      = errors.New("gateway error")
+)
+
+// Error is returned by transports when the gateway replies with a
+// 4.xx or 5.xx response code.
+type Error struct {
+	// Code is the CoAP response code, i.e. "4.04"
+	Code string
+	// Err is one of ErrBadRequest, ErrUnauthorized, ErrNotFound or ErrGateway
+	Err error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (%s)", e.Err, e.Code)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Cause returns the ErrBadRequest, ErrUnauthorized, ErrNotFound or ErrGateway
+// behind err, or err itself if it didn't come from a gateway reply.
+func Cause(err error) error {
+	if e, ok := err.(*Error); ok {
+		return e.Err
+	}
+	return err
+}
+
+// ErrorFromCode maps a CoAP response code in the "4.04" format to an *Error,
+// or returns nil if the code indicates success.
+func ErrorFromCode(code string) error {
+	if code == "" {
+		return nil
+	}
+	sp := strings.SplitN(code, ".", 2)
+	class, err := strconv.Atoi(sp[0])
+	if err != nil {
+		return &Error{Code: code, Err: ErrGateway}
+	}
+	var detail int
+	if len(sp) == 2 {
+		detail, _ = strconv.Atoi(sp[1])
+	}
+
+	switch class {
+	case 2:
+		return nil
+	case 4:
+		switch detail {
+		case 1, 3:
+			return &Error{Code: code, Err: ErrUnauthorized}
+		case 4:
+			return &Error{Code: code, Err: ErrNotFound}
+		default:
+			return &Error{Code: code, Err: ErrBadRequest}
+		}
+	default:
+		return &Error{Code: code, Err: ErrGateway}
+	}
+}
+
+// Errors is returned when several requests fail, i.e. by Refresh
+type Errors []error
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
@@ -0,0 +1,257 @@
+package tradfri
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+type EventType int
+
+const (
+	EventAdded EventType = iota
+	EventChanged
+	EventRemoved
+)
+
+func (e EventType) String() string {
+	switch e {
+	case EventAdded:
+		return "added"
+	case EventChanged:
+		return "changed"
+	case EventRemoved:
+		return "removed"
+	}
+	return "unknown"
+}
+
+type EventKind int
+
+const (
+	KindAccessory EventKind = iota
+	KindGroup
+	KindScene
+	KindGateway
+	KindNotification
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case KindAccessory:
+		return "accessory"
+	case KindGroup:
+		return "group"
+	case KindScene:
+		return "scene"
+	case KindGateway:
+		return "gateway"
+	case KindNotification:
+		return "notification"
+	}
+	return "unknown"
+}
+
+// Event is something that happened to the tree, only the field matching
+// Kind is set, except for scenes which also have their Group set.
+type Event struct {
+	Type EventType
+	Kind EventKind
+	// URI of the resource, i.e. 15001/65536
+	URI          string
+	Accessory    *Accessory
+	Group        *Group
+	Scene        *Scene
+	Gateway      *Gateway
+	Notification *Notification
+	// Changes is set for EventChanged
+	Changes []*ObservedChange
+}
+
+// EventFilter returns true for events that should be delivered
+type EventFilter func(e *Event) bool
+
+// KindFilter only lets events about the given kinds through
+func KindFilter(kinds ...EventKind) EventFilter {
+	return func(e *Event) bool {
+		for _, k := range kinds {
+			if e.Kind == k {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+type subscriber struct {
+	sync.Mutex
+	filter EventFilter
+	queue  []*Event
+	wake   chan struct{}
+}
+
+func (s *subscriber) push(e *Event) {
+	if s.filter != nil && !s.filter(e) {
+		return
+	}
+	s.Lock()
+	s.queue = append(s.queue, e)
+	s.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *subscriber) pop() *Event {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.queue) == 0 {
+		return nil
+	}
+	e := s.queue[0]
+	s.queue[0] = nil
+	s.queue = s.queue[1:]
+	return e
+}
+
+// Subscribe returns a channel of events matching filter, nil matches
+// everything. It starts with an EventAdded for everything already in the
+// tree. Events are delivered in the order they happened, without holding
+// the tree lock, and the channel is closed once the context is cancelled.
+func (t *Tree) Subscribe(ctx context.Context, filter EventFilter) <-chan *Event {
+	s := &subscriber{
+		filter: filter,
+		wake:   make(chan struct{}, 1),
+	}
+	ch := make(chan *Event)
+
+	t.Lock()
+	for _, e := range t.snapshot() {
+		s.push(e)
+	}
+	t.subscribers = append(t.subscribers, s)
+	t.Unlock()
+
+	go func() {
+		defer close(ch)
+		defer t.unsubscribe(s)
+		for {
+			e := s.pop()
+			if e == nil {
+				select {
+				case <-ctx.Done():
+					return
+				case <-s.wake:
+				}
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case ch <- e:
+			}
+		}
+	}()
+	return ch
+}
+
+func (t *Tree) unsubscribe(s *subscriber) {
+	t.Lock()
+	defer t.Unlock()
+	for i, v := range t.subscribers {
+		if v == s {
+			t.subscribers = append(t.subscribers[:i:i], t.subscribers[i+1:]...)
+			return
+		}
+	}
+}
+
+// emit must be called with the tree locked
+func (t *Tree) emit(e *Event) {
+	for _, s := range t.subscribers {
+		s.push(e)
+	}
+}
+
+// snapshot returns an EventAdded for everything in the tree, must be called
+// with the tree locked
+func (t *Tree) snapshot() []*Event {
+	events := []*Event{{
+		Type:    EventAdded,
+		Kind:    KindGateway,
+		URI:     GatewayEndpoint,
+		Gateway: t.Gateway,
+	}}
+	for _, n := range t.Notifications {
+		events = append(events, notificationEvent(EventAdded, n))
+	}
+	deviceIds := []int{}
+	for id := range t.Devices {
+		deviceIds = append(deviceIds, id)
+	}
+	sort.Ints(deviceIds)
+	for _, id := range deviceIds {
+		events = append(events, accessoryEvent(EventAdded, t.Devices[id]))
+	}
+	groupIds := []int{}
+	for id, g := range t.Groups {
+		if g.tree != nil {
+			groupIds = append(groupIds, id)
+		}
+	}
+	sort.Ints(groupIds)
+	for _, id := range groupIds {
+		events = append(events, groupEvent(EventAdded, t.Groups[id]))
+	}
+	for _, id := range groupIds {
+		g := t.Groups[id]
+		sceneIds := []int{}
+		for sceneId := range g.Scenes {
+			sceneIds = append(sceneIds, sceneId)
+		}
+		sort.Ints(sceneIds)
+		for _, sceneId := range sceneIds {
+			events = append(events, sceneEvent(EventAdded, g, g.Scenes[sceneId]))
+		}
+	}
+	return events
+}
+
+func accessoryEvent(typ EventType, d *Accessory) *Event {
+	return &Event{
+		Type:      typ,
+		Kind:      KindAccessory,
+		URI:       DeviceEndpoint + "/" + strconv.Itoa(d.GetInstanceID()),
+		Accessory: d,
+	}
+}
+
+func groupEvent(typ EventType, g *Group) *Event {
+	return &Event{
+		Type:  typ,
+		Kind:  KindGroup,
+		URI:   GroupEndpoint + "/" + strconv.Itoa(g.GetInstanceID()),
+		Group: g,
+	}
+}
+
+func notificationEvent(typ EventType, n *Notification) *Event {
+	return &Event{
+		Type:         typ,
+		Kind:         KindNotification,
+		URI:          NotificationEndpoint,
+		Notification: n,
+	}
+}
+
+func sceneEvent(typ EventType, g *Group, s *Scene) *Event {
+	return &Event{
+		Type:  typ,
+		Kind:  KindScene,
+		URI:   SceneEndpoint + "/" + strconv.Itoa(g.GetInstanceID()) + "/" + strconv.Itoa(s.GetInstanceID()),
+		Group: g,
+		Scene: s,
+	}
+}
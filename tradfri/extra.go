@@ -0,0 +1,155 @@
+package tradfri
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var extraType = reflect.TypeOf(map[string]json.RawMessage(nil))
+
+// extraFields describes where the codes of a struct end up
+type extraFields struct {
+	// known codes, including those of embedded structs
+	known map[string]bool
+	// extra is the index of the Extra field, nil if there is none
+	extra []int
+	// nested are the fields that may have an Extra field of their own
+	nested map[string][]int
+}
+
+var extraFieldsCache sync.Map
+
+func extraFieldsOf(t reflect.Type) *extraFields {
+	if f, ok := extraFieldsCache.Load(t); ok {
+		return f.(*extraFields)
+	}
+	f := &extraFields{known: map[string]bool{}, nested: map[string][]int{}}
+	if sf, ok := t.FieldByName("Extra"); ok && sf.Type == extraType {
+		f.extra = sf.Index
+	}
+	f.collect(t, nil)
+	extraFieldsCache.Store(t, f)
+	return f
+}
+
+func (f *extraFields) collect(t reflect.Type, index []int) {
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		idx := append(index[:len(index):len(index)], i)
+		code := strings.Split(sf.Tag.Get("json"), ",")[0]
+		if sf.Anonymous && code == "" {
+			if sf.Type.Kind() == reflect.Struct {
+				f.collect(sf.Type, idx)
+			}
+			continue
+		}
+		if sf.PkgPath != "" || code == "" || code == "-" {
+			continue
+		}
+		f.known[code] = true
+		if hasExtra(sf.Type) {
+			f.nested[code] = idx
+		}
+	}
+}
+
+func hasExtra(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return false
+	}
+	sf, ok := t.FieldByName("Extra")
+	return ok && sf.Type == extraType
+}
+
+// decode unmarshals data into v and keeps the codes that v doesn't know
+// about in the Extra field of v and of everything in it
+func decode(data []byte, v interface{}) error {
+	if err := json.Unmarshal(data, v); err != nil {
+		return err
+	}
+	fillExtra(data, reflect.ValueOf(v))
+	return nil
+}
+
+func fillExtra(data []byte, v reflect.Value) {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Slice:
+		var items []json.RawMessage
+		if json.Unmarshal(data, &items) != nil {
+			return
+		}
+		for i := 0; i < v.Len() && i < len(items); i++ {
+			fillExtra(items[i], v.Index(i))
+		}
+	case reflect.Struct:
+		var codes map[string]json.RawMessage
+		if json.Unmarshal(data, &codes) != nil {
+			return
+		}
+		f := extraFieldsOf(v.Type())
+		var extra map[string]json.RawMessage
+		for code, raw := range codes {
+			if idx, ok := f.nested[code]; ok {
+				fillExtra(raw, v.FieldByIndex(idx))
+			}
+			if f.known[code] {
+				continue
+			}
+			if extra == nil {
+				extra = map[string]json.RawMessage{}
+			}
+			extra[code] = raw
+		}
+		if f.extra != nil {
+			v.FieldByIndex(f.extra).Set(reflect.ValueOf(extra))
+		}
+	}
+}
+
+// extraChanges reports every code in Extra that was added, removed or
+// changed with the code as field, and updates o to n
+func extraChanges(path string, o *map[string]json.RawMessage, n map[string]json.RawMessage) []*ObservedChange {
+	codes := make([]string, 0, len(*o)+len(n))
+	for code := range *o {
+		codes = append(codes, code)
+	}
+	for code := range n {
+		if _, ok := (*o)[code]; !ok {
+			codes = append(codes, code)
+		}
+	}
+	sort.Strings(codes)
+
+	var updates []*ObservedChange
+	path = joinPath(path, "Extra")
+	for _, code := range codes {
+		ov, inOld := (*o)[code]
+		nv, inNew := n[code]
+		if inOld && inNew && bytes.Equal(ov, nv) {
+			continue
+		}
+		ch := &ObservedChange{Path: path, Field: code}
+		if inOld {
+			ch.OldValue = ov
+		}
+		if inNew {
+			ch.NewValue = nv
+		}
+		updates = append(updates, ch)
+	}
+	*o = n
+	return updates
+}
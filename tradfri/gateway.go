@@ -1,5 +1,7 @@
 package tradfri
 
+import "encoding/json"
+
 type Gateway struct {
 	observable
 	tree *Tree
@@ -45,18 +47,7 @@ type Gateway struct {
 	// Name
 	Name string `json:"9035"`
 
-	// Field* are unknown fields exposed by the gateway.
-	// Do not depend on the names staying the same
-	Field9060 int    `json:"9060"`
-	Field9062 int    `json:"9062"`
-	Field9072 int    `json:"9072"`
-	Field9073 int    `json:"9073"`
-	Field9074 int    `json:"9074"`
-	Field9075 int    `json:"9075"`
-	Field9076 int    `json:"9076"`
-	Field9077 int    `json:"9077"`
-	Field9078 int    `json:"9078"`
-	Field9079 int    `json:"9079"`
-	Field9080 int    `json:"9080"`
-	Field9081 string `json:"9081"`
+	// Extra holds the fields that are not known (yet) by IPSO code, such
+	// as 9062 and 9072 to 9081
+	Extra map[string]json.RawMessage `json:"-"`
 }
@@ -1,21 +1,30 @@
 package tradfri
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"strconv"
+	"sync"
 	"time"
 )
 
 type Group struct {
 	observable
 	pendingChanges *Group
+	flushTimer     *time.Timer
+	// sent is when changes were last sent, it has a lock of its own so it
+	// can be read while a Flush is waiting for the gateway
+	sent     time.Time
+	sentLock sync.Mutex
 	BaseType
 	Dimmable
-	Scene      *int  `json:"9039,omitempty"`
-	Members    []int `json:"9018,omitempty"`
-	memberRefs []*Accessory
-	Scenes     map[int]*Scene `json:"-"`
+	Scene          *int  `json:"9039,omitempty"`
+	Members        []int `json:"9018,omitempty"`
+	TransitionTime *int  `json:"5712,omitempty"`
+	memberRefs     []*Accessory
+	Scenes         map[int]*Scene             `json:"-"`
+	Extra          map[string]json.RawMessage `json:"-"`
 }
 
 type grpAccessoryRef struct {
@@ -69,21 +78,9 @@ func (g *Group) update(cb func(ch *Group)) {
 		g.pendingChanges = &Group{
 			BaseType: BaseType{tree: g.tree},
 		}
-		time.AfterFunc(50*time.Millisecond, func() {
-			g.Lock()
-			defer g.Unlock()
-			g.pendingChanges.Lock()
-			defer g.pendingChanges.Unlock()
-			b, err := json.Marshal(g.pendingChanges)
-			g.pendingChanges = nil
-			if err != nil {
-				log.Printf("Error marshaling pending changes json: %v", err)
-				return
-			}
-			url := "15004/" + strconv.Itoa(g.GetInstanceID())
-			log.Printf("Sending to %s: %s", url, string(b))
-			if err := g.tree.transport.Put(url, b); err != nil {
-				log.Printf("Error sending data %s: %v", string(b), err)
+		g.flushTimer = time.AfterFunc(50*time.Millisecond, func() {
+			if err := g.Flush(context.Background()); err != nil {
+				log.Printf("Error sending changes of %d: %v", g.GetInstanceID(), err)
 			}
 		})
 	}
@@ -92,6 +89,41 @@ func (g *Group) update(cb func(ch *Group)) {
 	cb(g.pendingChanges)
 }
 
+// Flush sends the pending changes to the gateway right away instead of
+// shortly after the last one, and returns the error if that failed
+func (g *Group) Flush(ctx context.Context) error {
+	g.Lock()
+	defer g.Unlock()
+	if g.pendingChanges == nil {
+		return nil
+	}
+	if g.flushTimer != nil {
+		g.flushTimer.Stop()
+		g.flushTimer = nil
+	}
+	g.pendingChanges.Lock()
+	b, err := json.Marshal(g.pendingChanges)
+	g.pendingChanges.Unlock()
+	g.pendingChanges = nil
+	if err != nil {
+		return err
+	}
+	url := "15004/" + strconv.Itoa(g.GetInstanceID())
+	log.Printf("Sending to %s: %s", url, string(b))
+	g.sentLock.Lock()
+	g.sent = time.Now()
+	g.sentLock.Unlock()
+	return g.tree.put(ctx, g, url, b)
+}
+
+// LastSent returns when changes of the group were last sent to the gateway,
+// to tell them apart from changes made by others
+func (g *Group) LastSent() time.Time {
+	g.sentLock.Lock()
+	defer g.sentLock.Unlock()
+	return g.sent
+}
+
 func (g *Group) SetOn(on bool) {
 	newVal := ToYesNo(on)
 	g.update(func(ch *Group) {
@@ -106,6 +138,23 @@ func (g *Group) SetDim(dim int) {
 	})
 }
 
+// SetScene activates the scene with id, which the gateway then reports as
+// the active one of the group
+func (g *Group) SetScene(id int) {
+	g.update(func(ch *Group) {
+		ch.Scene = &id
+	})
+}
+
+// SetTransitionTime makes the changes sent along with it fade over d
+// instead of the default of the gateway
+func (g *Group) SetTransitionTime(d time.Duration) {
+	t := transitionTime(d)
+	g.update(func(ch *Group) {
+		ch.TransitionTime = &t
+	})
+}
+
 func (g *Group) SetName(name string) {
 	g.update(func(ch *Group) {
 		ch.Name = name
@@ -0,0 +1,127 @@
+package tradfri
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// IPSONames maps the IPSO codes used by the gateway to what they are
+// thought to be, for the names of the codes in Extra and in dumps
+var IPSONames = map[string]string{
+	"3":     "device info",
+	"3300":  "sensor",
+	"3311":  "light",
+	"3312":  "plug",
+	"5523":  "trigger",
+	"5536":  "position",
+	"5601":  "min measured",
+	"5602":  "max measured",
+	"5603":  "min range",
+	"5604":  "max range",
+	"5700":  "sensor value",
+	"5701":  "unit",
+	"5706":  "color hex",
+	"5707":  "hue",
+	"5708":  "saturation",
+	"5709":  "color x",
+	"5710":  "color y",
+	"5711":  "color temperature",
+	"5712":  "transition time",
+	"5750":  "type",
+	"5800":  "active power",
+	"5805":  "cumulative active power",
+	"5820":  "power factor",
+	"5850":  "on",
+	"5851":  "dimmer",
+	"5852":  "on time",
+	"9001":  "name",
+	"9002":  "created at",
+	"9003":  "instance id",
+	"9014":  "state",
+	"9015":  "event",
+	"9017":  "details",
+	"9018":  "members",
+	"9019":  "alive",
+	"9020":  "last seen",
+	"9023":  "ntp server",
+	"9029":  "version",
+	"9032":  "force ota check",
+	"9035":  "gateway name",
+	"9039":  "scene",
+	"9054":  "update state",
+	"9055":  "update progress",
+	"9056":  "update url",
+	"9057":  "index",
+	"9058":  "active",
+	"9059":  "timestamp",
+	"9060":  "timestamp utc",
+	"9061":  "commissioning mode",
+	"9066":  "update priority",
+	"9068":  "predefined",
+	"9069":  "update accepted",
+	"9070":  "use current light settings",
+	"9071":  "time source",
+	"9081":  "gateway id",
+	"9083":  "homekit id",
+	"15001": "devices",
+	"15002": "accessory link",
+	"15004": "groups",
+	"15005": "scenes",
+	"15006": "notifications",
+	"15009": "switch",
+	"15011": "gateway",
+	"15013": "light settings",
+	"15015": "blind",
+}
+
+// deviceInfoNames are the codes inside device info, which mean something
+// else everywhere else
+var deviceInfoNames = map[string]string{
+	"0": "manufacturer",
+	"1": "model",
+	"2": "serial number",
+	"3": "firmware",
+	"6": "power source",
+	"9": "battery",
+}
+
+// CodeName returns what code is thought to be, or "" if it's unknown.
+// parent is the code of the object it's in, if any.
+func CodeName(parent, code string) string {
+	if parent == "3" {
+		return deviceInfoNames[code]
+	}
+	return IPSONames[code]
+}
+
+// Annotate adds the name of every known code to the keys of a payload, so
+// that "5850" becomes "5850 (on)"
+func Annotate(data []byte) ([]byte, error) {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(annotate("", v))
+}
+
+func annotate(parent string, v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for code, val := range v {
+			key := code
+			if name := CodeName(parent, code); name != "" {
+				key = code + " (" + name + ")"
+			}
+			m[key] = annotate(code, val)
+		}
+		return m
+	case []interface{}:
+		for i := range v {
+			v[i] = annotate(parent, v[i])
+		}
+	}
+	return v
+}
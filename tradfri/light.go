@@ -1,10 +1,24 @@
 package tradfri
 
+import (
+	"encoding/json"
+	"time"
+)
+
 type Light struct {
 	LightSetting
-	TransitionTime        *int     `json:"5712,omitempty"`
-	CumulativeActivePower *float64 `json:"5805,omitempty"`
-	OnTime                *int64   `json:"5852,omitempty"`
-	PowerFactor           *float64 `json:"5820,omitempty"`
-	Unit                  *string  `json:"5701,omitempty"`
+	TransitionTime        *int                       `json:"5712,omitempty"`
+	CumulativeActivePower *float64                   `json:"5805,omitempty"`
+	OnTime                *int64                     `json:"5852,omitempty"`
+	PowerFactor           *float64                   `json:"5820,omitempty"`
+	Unit                  *string                    `json:"5701,omitempty"`
+	Extra                 map[string]json.RawMessage `json:"-"`
+}
+
+// transitionTime converts d to the tenths of a second the gateway uses
+func transitionTime(d time.Duration) int {
+	if d < 0 {
+		return 0
+	}
+	return int((d + 50*time.Millisecond) / (100 * time.Millisecond))
 }
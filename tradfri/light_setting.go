@@ -1,8 +1,10 @@
 package tradfri
 
 import (
+	"encoding/json"
 	"github.com/lucasb-eyer/go-colorful"
 	"image/color"
+	"math"
 	"strings"
 )
 
@@ -16,6 +18,10 @@ const (
 	normalY = 26909
 	warmX   = 33135
 	warmY   = 27211
+
+	coldMireds   = 250
+	normalMireds = 370
+	warmMireds   = 454
 )
 
 type LightSetting struct {
@@ -26,8 +32,9 @@ type LightSetting struct {
 	Saturation int    `json:"5708,omitempty"`
 	ColorX     int    `json:"5709,omitempty"`
 	ColorY     int    `json:"5710,omitempty"`
-
-	Field5711 int `json:"5711,omitempty"`
+	// Mireds is the color temperature of white spectrum bulbs
+	Mireds int                        `json:"5711,omitempty"`
+	Extra  map[string]json.RawMessage `json:"-"`
 }
 
 func (l *LightSetting) SetColorTemp(c string) {
@@ -36,38 +43,82 @@ func (l *LightSetting) SetColorTemp(c string) {
 		l.Color = Cold
 		l.ColorX = coldX
 		l.ColorY = coldY
+		l.Mireds = coldMireds
 	case "normal", Normal:
 		l.Color = Normal
 		l.ColorX = normalX
 		l.ColorY = normalY
+		l.Mireds = normalMireds
 	case "warm", Warm:
 		l.Color = Warm
 		l.ColorX = warmX
 		l.ColorY = warmY
+		l.Mireds = warmMireds
 	}
 }
 
+// SetMireds sets any color temperature, along with the matching color for
+// bulbs that only understand that
+func (l *LightSetting) SetMireds(mireds int) {
+	l.Mireds = mireds
+	l.ColorX, l.ColorY = xyFromMireds(mireds)
+}
+
+// GetMireds returns the color temperature, from the color if the bulb
+// doesn't report it
+func (l *LightSetting) GetMireds() int {
+	if l.Mireds != 0 {
+		return l.Mireds
+	}
+	if l.ColorX != 0 && l.ColorY != 0 {
+		return miredsFromXY(l.ColorX, l.ColorY)
+	}
+	switch l.GetColorName() {
+	case "cold":
+		return coldMireds
+	case "warm":
+		return warmMireds
+	default:
+		return normalMireds
+	}
+}
+
+// SetColor sets the color as CIE xy, moved to the closest color the bulbs
+// can make. The brightness of the color is left to Dim.
 func (l *LightSetting) SetColor(color color.Color) {
-	var c colorful.Color
-	var ok bool
-	if c, ok = color.(colorful.Color); !ok {
+	c, ok := color.(colorful.Color)
+	if !ok {
 		c, _ = colorful.MakeColor(color)
 	}
-	h, s, _ := c.Hsv()
-	l.Hue = int(h*(65535/360) + 0.5)
-	if l.Hue >= 65535 {
-		l.Hue = 65535
-	}
-	l.Saturation = int(s*65279 + 0.5)
-	if l.Saturation >= 65279 {
-		l.Saturation = 65279
+	x, y := xyFromColor(c)
+	l.ColorX = int(x*65535 + 0.5)
+	l.ColorY = int(y*65535 + 0.5)
+}
+
+// SetHueSat sets the color as hue in degrees and saturation 0-1
+func (l *LightSetting) SetHueSat(hue, sat float64) {
+	l.Hue = int(math.Min(hue*hueScale+0.5, 65535))
+	l.Saturation = int(math.Min(sat*satScale+0.5, satScale))
+}
+
+// GetHueSat returns the hue in degrees and saturation 0-1, from xy if the
+// bulb reports it
+func (l *LightSetting) GetHueSat() (float64, float64) {
+	if l.ColorX != 0 || l.ColorY != 0 {
+		h, s, _ := colorFromXY(float64(l.ColorX)/65535, float64(l.ColorY)/65535, 1).Hsv()
+		return h, s
 	}
+	return float64(l.Hue) / hueScale, float64(l.Saturation) / satScale
 }
 
+// GetColor returns the color at the brightness of the bulb
 func (l *LightSetting) GetColor() colorful.Color {
-	hue := float64(l.Hue) / (65535 / 360)
-	sat := float64(l.Saturation) / 65279
-	return colorful.Hsv(hue, sat, 1)
+	h, s := l.GetHueSat()
+	brightness := 1.0
+	if l.Dim != nil {
+		brightness = l.DimPercent() / 100
+	}
+	return colorful.Hsv(h, s, brightness)
 }
 
 func (l *LightSetting) GetColorName() string {
@@ -96,6 +147,42 @@ func (l *LightSetting) SetColorWarm() {
 }
 
 func (l *LightSetting) HasColorTemperature() bool {
+	if l.Mireds != 0 {
+		return true
+	}
 	n := l.GetColorName()
 	return n == "cold" || n == "normal" || n == "warm"
 }
+
+// xyFromMireds follows the Planckian locus using the approximation by
+// Kim et al, scaled to 0-65535 like the gateway does
+func xyFromMireds(mireds int) (int, int) {
+	t := 1e6 / float64(mireds)
+	t = math.Max(1667, math.Min(25000, t))
+	var x, y float64
+	if t <= 4000 {
+		x = -0.2661239e9/(t*t*t) - 0.2343589e6/(t*t) + 0.8776956e3/t + 0.179910
+	} else {
+		x = -3.0258469e9/(t*t*t) + 2.1070379e6/(t*t) + 0.2226347e3/t + 0.240390
+	}
+	switch {
+	case t <= 2222:
+		y = -1.1063814*x*x*x - 1.34811020*x*x + 2.18555832*x - 0.20219683
+	case t <= 4000:
+		y = -0.9549476*x*x*x - 1.37418593*x*x + 2.09137015*x - 0.16748867
+	default:
+		y = 3.0817580*x*x*x - 5.87338670*x*x + 3.75112997*x - 0.37001483
+	}
+	return int(x*65535 + 0.5), int(y*65535 + 0.5)
+}
+
+// miredsFromXY uses McCamy's approximation
+func miredsFromXY(x, y int) int {
+	fx, fy := float64(x)/65535, float64(y)/65535
+	n := (fx - 0.3320) / (0.1858 - fy)
+	cct := 449*n*n*n + 3525*n*n + 6823.3*n + 5520.33
+	if cct <= 0 {
+		return 0
+	}
+	return int(1e6/cct + 0.5)
+}
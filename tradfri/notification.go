@@ -1,5 +1,11 @@
 package tradfri
 
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
 type NotificationEvent int
 
 const (
@@ -10,9 +16,10 @@ const (
 
 type Notification struct {
 	BaseType
-	Event   NotificationEvent `json:"9015,omitempty"`
-	Details []string          `json:"9017,omitempty"`
-	State   int               `json:"9014"`
+	Event   NotificationEvent          `json:"9015,omitempty"`
+	Details []string                   `json:"9017,omitempty"`
+	State   int                        `json:"9014"`
+	Extra   map[string]json.RawMessage `json:"-"`
 }
 
 func (n *Notification) EventString() string {
@@ -27,3 +34,35 @@ func (n *Notification) EventString() string {
 		return "Unknown event"
 	}
 }
+
+// key identifies a notification between two payloads of the list, by
+// instance id when the gateway sends one
+func (n *Notification) key() string {
+	if n.InstanceID != 0 {
+		return strconv.Itoa(n.InstanceID)
+	}
+	return strconv.Itoa(int(n.Event)) + "/" + strconv.FormatInt(n.CreatedAt, 10) + "/" + strings.Join(n.Details, ",")
+}
+
+// updateNotifications replaces the notifications of the tree, emitting an
+// EventRemoved for each one that's gone and an EventAdded for each new one.
+// Must be called with the tree locked.
+func (t *Tree) updateNotifications(notifications []*Notification) {
+	keys := map[string]bool{}
+	for _, n := range notifications {
+		keys[n.key()] = true
+	}
+	old := map[string]bool{}
+	for _, n := range t.Notifications {
+		old[n.key()] = true
+		if !keys[n.key()] {
+			t.emit(notificationEvent(EventRemoved, n))
+		}
+	}
+	t.Notifications = notifications
+	for _, n := range notifications {
+		if !old[n.key()] {
+			t.emit(notificationEvent(EventAdded, n))
+		}
+	}
+}
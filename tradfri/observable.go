@@ -2,27 +2,49 @@ package tradfri
 
 import (
 	"encoding/json"
+	"fmt"
 	//"log"
 	"reflect"
 	"strconv"
+	"strings"
+	"sync"
 )
 
 type ObservableCallback func(change []*ObservedChange)
 type ObserveFilter func(observation *ObservedChange) bool
 
 type observable struct {
-	observers []ObservableCallback
+	observersMu sync.RWMutex
+	observers   []*observer
 }
 
-func (o *observable) Observe(callback ObservableCallback) {
-	if o.observers == nil {
-		o.observers = []ObservableCallback{}
+type observer struct {
+	callback ObservableCallback
+}
+
+// Observe calls callback with every change, until the returned function
+// is called
+func (o *observable) Observe(callback ObservableCallback) func() {
+	ob := &observer{callback: callback}
+	o.observersMu.Lock()
+	defer o.observersMu.Unlock()
+	o.observers = append(o.observers, ob)
+	return func() {
+		o.observersMu.Lock()
+		defer o.observersMu.Unlock()
+		for i, v := range o.observers {
+			if v == ob {
+				o.observers = append(o.observers[:i:i], o.observers[i+1:]...)
+				return
+			}
+		}
 	}
-	o.observers = append(o.observers, callback)
 }
 
-func (o *observable) ObserveFilter(filter []ObserveFilter, callback ObservableCallback) {
-	o.observers = append(o.observers, func(change []*ObservedChange) {
+// ObserveFilter calls callback with the changes matching all filters, until
+// the returned function is called
+func (o *observable) ObserveFilter(filter []ObserveFilter, callback ObservableCallback) func() {
+	return o.Observe(func(change []*ObservedChange) {
 		ch := []*ObservedChange{}
 		for _, v := range change {
 			r := true
@@ -47,12 +69,46 @@ func (o *observable) OnChange(change []*ObservedChange) {
 		//log.Print("Called OnChange() on nil!")
 		return
 	}
-	if o.observers == nil {
-		//log.Printf("Called OnChange() with nil observers")
-		return
+	o.observersMu.RLock()
+	observers := o.observers
+	o.observersMu.RUnlock()
+	for _, b := range observers {
+		b.callback(change)
 	}
-	for _, b := range o.observers {
-		b(change)
+}
+
+// FieldFilter matches changes of any of the fields, i.e. "Dim"
+func FieldFilter(fields ...string) ObserveFilter {
+	return func(observation *ObservedChange) bool {
+		for _, f := range fields {
+			if observation.Field == f {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// PathFilter matches changes below prefix, i.e. "LightControl"
+func PathFilter(prefix string) ObserveFilter {
+	return func(observation *ObservedChange) bool {
+		return strings.HasPrefix(observation.Path, prefix)
+	}
+}
+
+// ValueFilter matches changes where fn returns true for the new value,
+// pointers are dereferenced first
+func ValueFilter(fn func(v interface{}) bool) ObserveFilter {
+	return func(observation *ObservedChange) bool {
+		v := observation.NewValue
+		if rv := reflect.ValueOf(v); rv.Kind() == reflect.Ptr {
+			if rv.IsNil() {
+				v = nil
+			} else {
+				v = rv.Elem().Interface()
+			}
+		}
+		return fn(v)
 	}
 }
 
@@ -63,16 +119,52 @@ type ObservedChange struct {
 	NewValue interface{}
 }
 
-func deepFields(iface interface{}) []string {
+// String formats the change for logging, with the name of the code for
+// the fields in Extra
+func (c *ObservedChange) String() string {
+	field := joinPath(c.Path, c.Field)
+	if c.Path == "Extra" || strings.HasSuffix(c.Path, "/Extra") {
+		parent := ""
+		if strings.HasPrefix(c.Path, "DeviceInfo/") {
+			parent = "3"
+		}
+		if name := CodeName(parent, c.Field); name != "" {
+			field += " (" + name + ")"
+		}
+	}
+	return fmt.Sprintf("%s: %s -> %s", field, formatValue(c.OldValue), formatValue(c.NewValue))
+}
+
+func formatValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "nil"
+	case json.RawMessage:
+		return string(v)
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return "nil"
+		}
+		if rv.Elem().Kind() != reflect.Struct {
+			return fmt.Sprint(rv.Elem().Interface())
+		}
+	}
+	return fmt.Sprint(v)
+}
+
+// deepFields works on the reflect.Value rather than a copy of the struct,
+// which would read the observers and locks without holding them
+func deepFields(ifv reflect.Value) []string {
 	ret := make([]string, 0)
-	ifv := reflect.ValueOf(iface)
-	ift := reflect.TypeOf(iface)
+	ift := ifv.Type()
 
 	for i := 0; i < ift.NumField(); i++ {
 		v := ifv.Field(i)
-		n := ifv.Type().Field(i).Name
-		ign := ifv.Type().Field(i).Tag.Get("json")
-		if ign == "-" {
+		n := ift.Field(i).Name
+		ign := ift.Field(i).Tag.Get("json")
+		if ign == "-" && v.Type() != extraType {
 			continue
 		}
 
@@ -83,7 +175,7 @@ func deepFields(iface interface{}) []string {
 
 		switch v.Kind() {
 		case reflect.Struct:
-			ret = append(ret, deepFields(v.Interface())...)
+			ret = append(ret, deepFields(v)...)
 		default:
 			ret = append(ret, n)
 		}
@@ -124,7 +216,7 @@ func compare(oldValue, newValue reflect.Value, prefix string) (updates []*Observ
 		return
 	}
 	//log.Printf("Parsing: %v", oldValue.Interface())
-	fields := deepFields(oldValue.Interface())
+	fields := deepFields(oldValue)
 	for _, fName := range fields {
 		if byte(fName[0])&0x60 != 0x40 {
 			// Field is not exported
@@ -186,6 +278,10 @@ func compare(oldValue, newValue reflect.Value, prefix string) (updates []*Observ
 				continue
 			}
 		}
+		if fOld.Type() == extraType {
+			updates = append(updates, extraChanges(prefix, fOld.Addr().Interface().(*map[string]json.RawMessage), fNew.Interface().(map[string]json.RawMessage))...)
+			continue
+		}
 		if !reflect.DeepEqual(fOld.Interface(), fNew.Interface()) {
 			updates = append(updates, &ObservedChange{
 				Path:     prefix,
@@ -199,23 +295,27 @@ func compare(oldValue, newValue reflect.Value, prefix string) (updates []*Observ
 	return
 }
 
-func update(j []byte, o interface{}) error {
+// update applies the json to o, calling its observers with and returning
+// what changed. Types implementing differ are compared without reflection.
+func update(j []byte, o interface{}) ([]*ObservedChange, error) {
 	oldValue := reflect.ValueOf(o)
 
-	m := oldValue.MethodByName("OnChange")
-	/*if !m.IsValid() {
-		return json.Unmarshal(j, oldValue.Interface())
-	}*/
-
 	newValue := reflect.New(reflect.TypeOf(o).Elem())
-	err := json.Unmarshal(j, newValue.Interface())
+	err := decode(j, newValue.Interface())
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	updates := compare(oldValue, newValue, "")
+	var updates []*ObservedChange
+	if d, ok := o.(differ); ok {
+		updates = d.diff(newValue.Interface())
+	} else {
+		updates = compare(oldValue, newValue, "")
+	}
 
-	m.Call([]reflect.Value{reflect.ValueOf(updates)})
+	if ob, ok := o.(interface{ OnChange([]*ObservedChange) }); ok && len(updates) > 0 {
+		ob.OnChange(updates)
+	}
 
-	return nil
+	return updates, nil
 }
@@ -1,7 +1,16 @@
 package tradfri
 
-// Plug struct, not sure what it should contain
+import "encoding/json"
+
+// Plug is an outlet, the energy fields are only there if the outlet
+// measures them
 type Plug struct {
 	BaseType
 	OnOff
+	ActivePower           *float64                   `json:"5800,omitempty"`
+	CumulativeActivePower *float64                   `json:"5805,omitempty"`
+	PowerFactor           *float64                   `json:"5820,omitempty"`
+	OnTime                *int64                     `json:"5852,omitempty"`
+	Unit                  *string                    `json:"5701,omitempty"`
+	Extra                 map[string]json.RawMessage `json:"-"`
 }
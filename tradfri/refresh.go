@@ -0,0 +1,197 @@
+package tradfri
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Refresh fetches everything from the gateway, adding anything missing
+// from the tree and removing what's no longer there. A failed request
+// doesn't stop the rest, the failures are returned together as Errors.
+func (t *Tree) Refresh(ctx context.Context) error {
+	var errs Errors
+	fetch := func(uri string) {
+		if err := t.fetch(ctx, uri); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", uri, err))
+		}
+	}
+	fetchList := func(uri string) []int {
+		list, err := t.fetchList(ctx, uri)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", uri, err))
+		}
+		return list
+	}
+
+	fetch(GatewayEndpoint)
+	fetch(NotificationEndpoint)
+
+	for _, id := range fetchList(DeviceEndpoint) {
+		fetch(DeviceEndpoint + "/" + strconv.Itoa(id))
+	}
+
+	for _, id := range fetchList(GroupEndpoint) {
+		fetch(GroupEndpoint + "/" + strconv.Itoa(id))
+		sceneURI := SceneEndpoint + "/" + strconv.Itoa(id)
+		for _, sceneId := range fetchList(sceneURI) {
+			fetch(sceneURI + "/" + strconv.Itoa(sceneId))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// RefreshEvery calls Refresh every interval until the context is cancelled
+func (t *Tree) RefreshEvery(ctx context.Context, interval time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		if err := t.Refresh(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Error refreshing tree: %v", err)
+		}
+	}
+}
+
+// fetch gets uri from the gateway and populates the tree with it, a 4.04
+// removes it from the tree
+func (t *Tree) fetch(ctx context.Context, uri string) error {
+	rctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	data, err := t.transport.GetContext(rctx, uri)
+	if Cause(err) == ErrNotFound {
+		data, err = nil, nil
+	}
+	if err != nil {
+		return err
+	}
+	return t.Populate(strings.Split(uri, "/"), data)
+}
+
+// fetchList gets a list of ids, removing anything not in it from the tree
+func (t *Tree) fetchList(ctx context.Context, uri string) ([]int, error) {
+	rctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	data, err := t.transport.GetContext(rctx, uri)
+	if Cause(err) == ErrNotFound {
+		data, err = []byte("[]"), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	list := []int{}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	t.Lock()
+	defer t.Unlock()
+	if err := t.reconcile(strings.Split(uri, "/"), data, false); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// fetchMissing fetches uri in the background unless already doing so,
+// must be called with the tree locked
+func (t *Tree) fetchMissing(uri string) {
+	if t.fetching[uri] {
+		return
+	}
+	t.fetching[uri] = true
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		defer cancel()
+		if err := t.fetch(ctx, uri); err != nil {
+			log.Printf("Error fetching %s: %v", uri, err)
+		}
+		t.Lock()
+		defer t.Unlock()
+		delete(t.fetching, uri)
+	}()
+}
+
+// reconcile compares a list of ids, i.e. the payload of 15001, with the tree.
+// Anything not in the list is removed and, if fetchMissing is set, anything
+// not in the tree is fetched. Must be called with the tree locked.
+func (t *Tree) reconcile(path []string, data []byte, fetchMissing bool) error {
+	if len(data) == 0 {
+		return nil
+	}
+	list := []int{}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	ids := map[int]bool{}
+	for _, id := range list {
+		ids[id] = true
+	}
+	uri := strings.Join(path, "/")
+
+	switch {
+	case uri == DeviceEndpoint:
+		for id := range t.Devices {
+			if !ids[id] {
+				t.removeAccessory(id)
+			}
+		}
+		for id := range ids {
+			if _, ok := t.Devices[id]; !ok && fetchMissing {
+				t.fetchMissing(uri + "/" + strconv.Itoa(id))
+			}
+		}
+	case uri == GroupEndpoint:
+		for id := range t.Groups {
+			if !ids[id] {
+				t.removeGroup(id)
+			}
+		}
+		for id := range ids {
+			if g, ok := t.Groups[id]; (!ok || g.tree == nil) && fetchMissing {
+				t.fetchMissing(uri + "/" + strconv.Itoa(id))
+			}
+		}
+	case uri == SceneEndpoint:
+		// List of groups that have scenes
+		for id, g := range t.Groups {
+			if ids[id] {
+				if len(g.Scenes) == 0 && fetchMissing {
+					t.fetchMissing(uri + "/" + strconv.Itoa(id))
+				}
+				continue
+			}
+			for sceneId := range g.Scenes {
+				t.removeScene(id, sceneId)
+			}
+		}
+	case path[0] == SceneEndpoint && len(path) == 2:
+		groupId, err := strconv.Atoi(path[1])
+		if err != nil {
+			return err
+		}
+		g, ok := t.Groups[groupId]
+		for sceneId := range ids {
+			if (!ok || g.Scenes[sceneId] == nil) && fetchMissing {
+				t.fetchMissing(uri + "/" + strconv.Itoa(sceneId))
+			}
+		}
+		if !ok {
+			return nil
+		}
+		for sceneId := range g.Scenes {
+			if !ids[sceneId] {
+				t.removeScene(groupId, sceneId)
+			}
+		}
+	}
+	return nil
+}
@@ -1,6 +1,16 @@
 package tradfri
 
-// Sensor struct, not sure what it should contain
+import "encoding/json"
+
+// Sensor is an IPSO sensor (3300). The motion sensor only reports its
+// instance ID, motion is only noticeable through the groups it controls.
 type Sensor struct {
 	BaseType
+	Value       *float64                   `json:"5700,omitempty"`
+	Unit        *string                    `json:"5701,omitempty"`
+	MinMeasured *float64                   `json:"5601,omitempty"`
+	MaxMeasured *float64                   `json:"5602,omitempty"`
+	MinRange    *float64                   `json:"5603,omitempty"`
+	MaxRange    *float64                   `json:"5604,omitempty"`
+	Extra       map[string]json.RawMessage `json:"-"`
 }
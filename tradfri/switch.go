@@ -1,5 +1,8 @@
 package tradfri
 
+import "encoding/json"
+
 type Switch struct {
 	BaseType
+	Extra map[string]json.RawMessage `json:"-"`
 }
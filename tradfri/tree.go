@@ -1,28 +1,46 @@
 package tradfri
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
+	"log"
 	"strconv"
 	"strings"
 	"sync"
 )
 
+// ObservableTransport can be told about changes to a resource without
+// asking for them. Observe returns a function that stops the observation,
+// after which callback isn't called anymore.
 type ObservableTransport interface {
 	Transport
-	Observe(method, uri string, callback func(data []byte)) error
+	Observe(method, uri string, callback func(data []byte)) (func(), error)
 }
 
+// DiscoverCallback is called for everything added to or removed from the
+// tree, see Subscribe for more details
 type DiscoverCallback interface {
 	OnNewAccessory(d *Accessory)
 	OnNewGroup(g *Group)
 	OnNewScene(g *Group, s *Scene)
+	OnRemoveAccessory(d *Accessory)
+	OnRemoveGroup(g *Group)
+	OnRemoveScene(g *Group, s *Scene)
+}
+
+// ErrorCallback can optionally be implemented by a DiscoverCallback to be
+// told when sending changes of an Accessory or Group to the gateway failed.
+type ErrorCallback interface {
+	OnError(i Instance, err error)
 }
 
 type Transport interface {
 	Get(uri string) ([]byte, error)
 	Put(uri string, data []byte) error
 	Delete(uri string) error
+	GetContext(ctx context.Context, uri string) ([]byte, error)
+	PutContext(ctx context.Context, uri string, data []byte) error
+	DeleteContext(ctx context.Context, uri string) error
 }
 
 type Tree struct {
@@ -32,7 +50,12 @@ type Tree struct {
 	Notifications []*Notification
 	Gateway       *Gateway
 	transport     Transport
-	callback      []DiscoverCallback
+	subscribers   []*subscriber
+	onError       []ErrorCallback
+	observed      map[string]*observation
+	fetching      map[string]bool
+	state         map[string][]byte
+	changed       chan struct{}
 }
 
 func NewTree(transport Transport) *Tree {
@@ -42,38 +65,220 @@ func NewTree(transport Transport) *Tree {
 		Notifications: []*Notification{},
 		Gateway:       &Gateway{},
 		transport:     transport,
-		callback:      []DiscoverCallback{},
+		observed:      map[string]*observation{},
+		fetching:      map[string]bool{},
+		state:         map[string][]byte{},
+		changed:       make(chan struct{}, 1),
 	}
 	t.Gateway.tree = t
 	return t
 }
 
-func (t *Tree) AddCallback(callback DiscoverCallback) {
-	t.callback = append(t.callback, callback)
+// AddCallback calls callback for everything in and later added to or
+// removed from the tree until the context is cancelled. If it also
+// implements ErrorCallback it's told about errors for as long.
+func (t *Tree) AddCallback(ctx context.Context, callback DiscoverCallback) {
+	var hook *errorHook
+	if ec, ok := callback.(ErrorCallback); ok {
+		hook = &errorHook{ec}
+		t.AddErrorCallback(hook)
+	}
+	events := t.Subscribe(ctx, KindFilter(KindAccessory, KindGroup, KindScene))
+	go func() {
+		for e := range events {
+			switch {
+			case e.Kind == KindAccessory && e.Type == EventAdded:
+				callback.OnNewAccessory(e.Accessory)
+			case e.Kind == KindAccessory && e.Type == EventRemoved:
+				callback.OnRemoveAccessory(e.Accessory)
+			case e.Kind == KindGroup && e.Type == EventAdded:
+				callback.OnNewGroup(e.Group)
+			case e.Kind == KindGroup && e.Type == EventRemoved:
+				callback.OnRemoveGroup(e.Group)
+			case e.Kind == KindScene && e.Type == EventAdded:
+				callback.OnNewScene(e.Group, e.Scene)
+			case e.Kind == KindScene && e.Type == EventRemoved:
+				callback.OnRemoveScene(e.Group, e.Scene)
+			}
+		}
+		if hook != nil {
+			t.removeErrorCallback(hook)
+		}
+	}()
+}
+
+// errorHook wraps the ErrorCallback of a DiscoverCallback so that it can be
+// found again for removal
+type errorHook struct {
+	ErrorCallback
+}
+
+// AddErrorCallback is called whenever changes of an Accessory or Group
+// couldn't be sent to the gateway
+func (t *Tree) AddErrorCallback(callback ErrorCallback) {
+	t.Lock()
+	defer t.Unlock()
+	t.onError = append(t.onError, callback)
+}
+
+func (t *Tree) removeErrorCallback(hook *errorHook) {
+	t.Lock()
+	defer t.Unlock()
+	for i, ec := range t.onError {
+		if h, ok := ec.(*errorHook); ok && h == hook {
+			t.onError = append(t.onError[:i:i], t.onError[i+1:]...)
+			return
+		}
+	}
+}
+
+// put sends data to the gateway on behalf of i, reporting failures to the
+// error callbacks.
+func (t *Tree) put(ctx context.Context, i Instance, uri string, data []byte) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, requestTimeout)
+		defer cancel()
+	}
+	err := t.transport.PutContext(ctx, uri, data)
+	if err == nil {
+		return nil
+	}
+	if Cause(err) == ErrNotFound {
+		// Removed from the gateway
+		_ = t.Populate(strings.Split(uri, "/"), nil)
+	}
+	t.RLock()
+	defer t.RUnlock()
+	t.reportError(i, err)
+	return err
+}
+
+// ReportError tells the error callbacks that changes sent to uri were lost,
+// for transports that only find out after PutContext has returned
+func (t *Tree) ReportError(uri string, err error) {
+	t.RLock()
+	defer t.RUnlock()
+	path := strings.Split(uri, "/")
+	id, perr := strconv.Atoi(path[len(path)-1])
+	if len(path) != 2 || perr != nil {
+		return
+	}
+	switch path[0] {
+	case DeviceEndpoint:
+		if a, ok := t.Devices[id]; ok {
+			t.reportError(a, err)
+		}
+	case GroupEndpoint:
+		if g, ok := t.Groups[id]; ok {
+			t.reportError(g, err)
+		}
+	}
+}
+
+// reportError must be called with the tree locked
+func (t *Tree) reportError(i Instance, err error) {
+	for _, ec := range t.onError {
+		go ec.OnError(i, err)
+	}
+}
+
+// observation is a resource observed with the transport, cancel is nil until
+// the transport has registered it
+type observation struct {
+	cancel func()
+}
+
+// observe registers an observation of path with the transport, if it supports
+// it. Must be called with the tree locked.
+func (t *Tree) observe(path []string) {
+	ot, ok := t.transport.(ObservableTransport)
+	if !ok {
+		return
+	}
+	uri := strings.Join(path, "/")
+	if _, ok := t.observed[uri]; ok {
+		return
+	}
+	o := &observation{}
+	t.observed[uri] = o
+	path = append([]string{}, path...)
+	go func() {
+		cancel, err := ot.Observe("get", uri, func(data []byte) {
+			t.RLock()
+			current := t.observed[uri] == o
+			t.RUnlock()
+			if !current {
+				// Late notification of something no longer observed
+				return
+			}
+			if err := t.Populate(path, data); err != nil {
+				log.Printf("Error parsing observed %s: %v", uri, err)
+			}
+		})
+		t.Lock()
+		defer t.Unlock()
+		if err != nil {
+			log.Printf("Error observing %s: %v", uri, err)
+			if t.observed[uri] == o {
+				delete(t.observed, uri)
+			}
+			return
+		}
+		if t.observed[uri] != o {
+			// Removed while the transport was registering it
+			cancel()
+			return
+		}
+		o.cancel = cancel
+	}()
+}
+
+// unobserve stops observing uri, must be called with the tree locked
+func (t *Tree) unobserve(uri string) {
+	o, ok := t.observed[uri]
+	if !ok {
+		return
+	}
+	delete(t.observed, uri)
+	if o.cancel != nil {
+		o.cancel()
+	}
 }
 
 func (t *Tree) Populate(path []string, data []byte) error {
 	t.Lock()
 	defer t.Unlock()
+	if err := t.populate(path, data); err != nil {
+		return err
+	}
+	t.store(path, data)
+	return nil
+}
+
+// populate must be called with the tree locked
+func (t *Tree) populate(path []string, data []byte) error {
 	uri := strings.Join(path, "/")
 
 	switch uri {
-	case DeviceEndpoint:
-		// Got list of devices
-		return nil
-	case GroupEndpoint:
-		// Got list of groups
-		return nil
-	case SceneEndpoint:
-		// Got list of scenes
-		return nil
+	case DeviceEndpoint, GroupEndpoint, SceneEndpoint:
+		return t.reconcile(path, data, true)
 	case GatewayEndpoint:
-		return update(data, t.Gateway)
-	case NotificationEndpoint:
-		err := json.Unmarshal(data, &t.Notifications)
+		t.observe(path)
+		changes, err := update(data, t.Gateway)
 		if err != nil {
 			return err
 		}
+		if len(changes) > 0 {
+			t.emit(&Event{Type: EventChanged, Kind: KindGateway, URI: uri, Gateway: t.Gateway, Changes: changes})
+		}
+		return nil
+	case NotificationEndpoint:
+		notifications := []*Notification{}
+		if err := decode(data, &notifications); err != nil {
+			return err
+		}
+		t.updateNotifications(notifications)
 		return nil
 	}
 
@@ -90,22 +295,46 @@ func (t *Tree) Populate(path []string, data []byte) error {
 		return fmt.Errorf("expected int as second param, got %s", path[1])
 	}
 
+	if len(data) == 0 {
+		// Empty payload, the resource was removed
+		switch {
+		case path[0] == DeviceEndpoint:
+			t.removeAccessory(id)
+		case path[0] == GroupEndpoint:
+			t.removeGroup(id)
+		case path[0] == SceneEndpoint && len(path) == 3:
+			if sceneId, err := strconv.Atoi(path[2]); err == nil {
+				t.removeScene(id, sceneId)
+			}
+		}
+		return nil
+	}
+
 	var ok bool
 	switch path[0] {
 	case DeviceEndpoint:
 		var d *Accessory
+		var isNew bool
 		if d, ok = t.Devices[id]; !ok {
 			d = &Accessory{}
 			d.InstanceID = id
 			d.tree = t
 			t.Devices[id] = d
-			defer func() {
-				for _, v := range t.callback {
-					v.OnNewAccessory(d)
-				}
-			}()
+			t.observe(path)
+			isNew = true
 		}
-		return update(data, d)
+		changes, err := update(data, d)
+		if err != nil {
+			return err
+		}
+		if isNew {
+			t.emit(accessoryEvent(EventAdded, d))
+		} else if len(changes) > 0 {
+			e := accessoryEvent(EventChanged, d)
+			e.Changes = changes
+			t.emit(e)
+		}
+		return nil
 	case GroupEndpoint:
 		var d *Group
 		var isNew bool
@@ -120,13 +349,20 @@ func (t *Tree) Populate(path []string, data []byte) error {
 		if isNew {
 			d.tree = t
 			d.InstanceID = id
-			defer func() {
-				for _, v := range t.callback {
-					v.OnNewGroup(d)
-				}
-			}()
+			t.observe(path)
+		}
+		changes, err := update(data, d)
+		if err != nil {
+			return err
 		}
-		return update(data, d)
+		if isNew {
+			t.emit(groupEvent(EventAdded, d))
+		} else if len(changes) > 0 {
+			e := groupEvent(EventChanged, d)
+			e.Changes = changes
+			t.emit(e)
+		}
+		return nil
 	case SceneEndpoint:
 		if len(path) == 3 {
 			sceneId, err := strconv.Atoi(path[2])
@@ -143,24 +379,79 @@ func (t *Tree) Populate(path []string, data []byte) error {
 			}
 
 			var scn *Scene
-			var ok bool
+			var isNew bool
 			if scn, ok = grp.Scenes[sceneId]; !ok {
 				scn = &Scene{}
 				scn.group = grp
 				scn.InstanceID = sceneId
 				scn.tree = t
 				grp.Scenes[sceneId] = scn
-				defer func() {
-					for _, v := range t.callback {
-						v.OnNewScene(grp, scn)
-					}
-				}()
+				t.observe(path)
+				isNew = true
 			}
 
-			return update(data, scn)
+			changes, err := update(data, scn)
+			if err != nil {
+				return err
+			}
+			if isNew {
+				t.emit(sceneEvent(EventAdded, grp, scn))
+			} else if len(changes) > 0 {
+				e := sceneEvent(EventChanged, grp, scn)
+				e.Changes = changes
+				t.emit(e)
+			}
+			return nil
 		}
-		return nil
+		return t.reconcile(path, data, true)
 	default:
 		return fmt.Errorf("got data at unknown endpoint %s: %s", uri, string(data))
 	}
 }
+
+// removeAccessory must be called with the tree locked
+func (t *Tree) removeAccessory(id int) {
+	d, ok := t.Devices[id]
+	if !ok {
+		return
+	}
+	uri := DeviceEndpoint + "/" + strconv.Itoa(id)
+	delete(t.Devices, id)
+	t.unobserve(uri)
+	t.forget(uri)
+	t.emit(accessoryEvent(EventRemoved, d))
+}
+
+// removeGroup removes the group and all its scenes, must be called with the
+// tree locked
+func (t *Tree) removeGroup(id int) {
+	g, ok := t.Groups[id]
+	if !ok {
+		return
+	}
+	for sceneId := range g.Scenes {
+		t.removeScene(id, sceneId)
+	}
+	uri := GroupEndpoint + "/" + strconv.Itoa(id)
+	delete(t.Groups, id)
+	t.unobserve(uri)
+	t.forget(uri)
+	t.emit(groupEvent(EventRemoved, g))
+}
+
+// removeScene must be called with the tree locked
+func (t *Tree) removeScene(groupId, sceneId int) {
+	g, ok := t.Groups[groupId]
+	if !ok {
+		return
+	}
+	s, ok := g.Scenes[sceneId]
+	if !ok {
+		return
+	}
+	uri := SceneEndpoint + "/" + strconv.Itoa(groupId) + "/" + strconv.Itoa(sceneId)
+	delete(g.Scenes, sceneId)
+	t.unobserve(uri)
+	t.forget(uri)
+	t.emit(sceneEvent(EventRemoved, g, s))
+}
@@ -1,18 +1,22 @@
 package transport
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
 	"github.com/satori/go.uuid"
+	"hemtjan.st/sladdlos/tradfri"
 	"log"
 	"time"
 )
 
+const requestTimeout = 10 * time.Second
+
 type tradfriRaw struct {
 	Method     string          `json:"method"`
 	URL        string          `json:"url"`
 	ID         string          `json:"id,omitempty"`
 	ReplyTopic string          `json:"replyTopic,omitempty"`
+	Observe    bool            `json:"observe,omitempty"`
 	Payload    json.RawMessage `json:"payload"`
 }
 
@@ -55,7 +59,12 @@ func (t *Transport) onReply(msg []byte) {
 	}()
 }
 
-func (t *Transport) makeReq(method, uri string, payload []byte) ([]byte, error) {
+func (t *Transport) makeReq(ctx context.Context, method, uri string, payload []byte) ([]byte, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, requestTimeout)
+		defer cancel()
+	}
 	ch := make(chan *tradfriReply)
 	id := uuid.NewV4().String()
 	t.Lock()
@@ -70,7 +79,7 @@ func (t *Transport) makeReq(method, uri string, payload []byte) ([]byte, error)
 	req := &tradfriRaw{
 		Method:     method,
 		URL:        uri,
-		ReplyTopic: "tradfri-reply/" + t.id,
+		ReplyTopic: t.ReplyTopic + "/" + t.id,
 		ID:         id,
 	}
 	if payload != nil {
@@ -80,26 +89,89 @@ func (t *Transport) makeReq(method, uri string, payload []byte) ([]byte, error)
 	if err != nil {
 		return nil, err
 	}
-	t.client.Publish("tradfri-cmd", js, false)
+	t.client.Publish(t.CmdTopic, js, false)
 
 	select {
 	case r := <-ch:
+		t.setOnline(true)
+		if err := tradfri.ErrorFromCode(r.Code); err != nil {
+			return nil, err
+		}
 		return r.Payload, nil
-	case <-time.After(10 * time.Second):
-		return nil, fmt.Errorf("timeout after 10 seconds")
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			t.setOnline(false)
+			return nil, errTimeout
+		}
+		return nil, ctx.Err()
 	}
 }
 
 func (t *Transport) Get(uri string) ([]byte, error) {
-	return t.makeReq("get", uri, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	return t.GetContext(ctx, uri)
 }
 
 func (t *Transport) Put(uri string, data []byte) error {
-	_, err := t.makeReq("put", uri, data)
-	return err
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	return t.PutContext(ctx, uri, data)
 }
 
 func (t *Transport) Delete(uri string) error {
-	_, err := t.makeReq("delete", uri, nil)
-	return err
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	return t.DeleteContext(ctx, uri)
+}
+
+func (t *Transport) GetContext(ctx context.Context, uri string) ([]byte, error) {
+	return t.makeReq(ctx, "get", uri, nil)
+}
+
+func (t *Transport) PutContext(ctx context.Context, uri string, data []byte) error {
+	return t.command(ctx, "put", uri, data)
+}
+
+func (t *Transport) DeleteContext(ctx context.Context, uri string) error {
+	return t.command(ctx, "delete", uri, nil)
+}
+
+type observer struct {
+	callback func(data []byte)
+}
+
+// Observe asks tradfri-mqtt to observe the uri and calls callback with
+// every payload published for it on tradfri-raw. tradfri-mqtt keeps
+// publishing after the observation is cancelled, it's only ignored.
+func (t *Transport) Observe(method, uri string, callback func(data []byte)) (func(), error) {
+	js, err := json.Marshal(&tradfriRaw{
+		Method:  method,
+		URL:     uri,
+		Observe: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	o := &observer{callback: callback}
+	t.Lock()
+	t.observers[uri] = append(t.observers[uri], o)
+	t.Unlock()
+	t.client.Publish(t.CmdTopic, js, false)
+	return func() {
+		t.Lock()
+		defer t.Unlock()
+		observers := t.observers[uri]
+		for i, obs := range observers {
+			if obs == o {
+				observers = append(observers[:i:i], observers[i+1:]...)
+				break
+			}
+		}
+		if len(observers) == 0 {
+			delete(t.observers, uri)
+		} else {
+			t.observers[uri] = observers
+		}
+	}, nil
 }
@@ -6,32 +6,73 @@ import (
 	"log"
 	"strings"
 	"sync"
+	"time"
 )
 
 type Transport struct {
 	sync.RWMutex
-	client  mqtt.MQTT
-	id      string
-	tree    *tradfri.Tree
-	waiting map[string]chan *tradfriReply
+	// Retries is the number of times a queued command is retried before
+	// being dropped, a negative value retries forever
+	Retries int
+	// Backoff is the initial delay between retries, it's doubled for
+	// every attempt up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// StatusTopic is where tradfri-mqtt publishes its status (i.e. as last
+	// will), if set it's used to know when the bridge goes away and returns
+	StatusTopic string
+	// RawTopic, CmdTopic and ReplyTopic are where tradfri-mqtt publishes
+	// resources, reads commands and publishes replies. Set with SetPrefix.
+	RawTopic   string
+	CmdTopic   string
+	ReplyTopic string
+	client     mqtt.MQTT
+	id         string
+	tree       *tradfri.Tree
+	waiting    map[string]chan *tradfriReply
+	observers  map[string][]*observer
+	qmu        sync.Mutex
+	online     bool
+	queue      []*command
+	draining   bool
+	wake       chan struct{}
 }
 
 func NewTransport(mq mqtt.MQTT, id string) *Transport {
 	m := &Transport{
-		client:  mq,
-		id:      id,
-		waiting: map[string]chan *tradfriReply{},
+		RawTopic:   "tradfri-raw",
+		CmdTopic:   "tradfri-cmd",
+		ReplyTopic: "tradfri-reply",
+		Retries:    10,
+		Backoff:    time.Second,
+		MaxBackoff: time.Minute,
+		client:     mq,
+		id:         id,
+		waiting:    map[string]chan *tradfriReply{},
+		observers:  map[string][]*observer{},
+		online:     true,
+		wake:       make(chan struct{}, 1),
 	}
 	return m
 }
 
+// SetPrefix sets the topics to <prefix>-raw, <prefix>-cmd and <prefix>-reply,
+// as used by a tradfri-mqtt instance started with that prefix.
+func (t *Transport) SetPrefix(prefix string) {
+	t.Lock()
+	defer t.Unlock()
+	t.RawTopic = prefix + "-raw"
+	t.CmdTopic = prefix + "-cmd"
+	t.ReplyTopic = prefix + "-reply"
+}
+
 func (t *Transport) SetTree(tree *tradfri.Tree) {
 	t.Lock()
 	defer t.Unlock()
 	if tree == nil {
 		t.tree = nil
 		if t.client != nil {
-			t.client.Unsubscribe("tradfri-raw/#")
+			t.client.Unsubscribe(t.RawTopic + "/#")
 		}
 		return
 	}
@@ -47,12 +88,23 @@ func (t *Transport) onMessage(msg *mqtt.Packet) {
 	if t.tree == nil {
 		return
 	}
-	topic := strings.Split(msg.TopicName, "/")
-	if len(topic) < 2 || topic[0] != "tradfri-raw" {
+	if !strings.HasPrefix(msg.TopicName, t.RawTopic+"/") {
+		return
+	}
+	uri := strings.TrimPrefix(msg.TopicName, t.RawTopic+"/")
+	if !msg.IsRetain {
+		t.setOnline(true)
+	}
+	if observers, ok := t.observers[uri]; ok {
+		go func() {
+			for _, o := range observers {
+				o.callback(msg.Payload)
+			}
+		}()
 		return
 	}
 	go func() {
-		err := t.tree.Populate(topic[1:], msg.Payload)
+		err := t.tree.Populate(strings.Split(uri, "/"), msg.Payload)
 
 		if err != nil {
 			log.Print(err)
@@ -62,11 +114,21 @@ func (t *Transport) onMessage(msg *mqtt.Packet) {
 }
 
 func (t *Transport) subscribe() {
-	msgCh := t.client.SubscribeRaw("tradfri-raw/#")
-	rplCh := t.client.Subscribe("tradfri-reply/" + t.id)
+	msgCh := t.client.SubscribeRaw(t.RawTopic + "/#")
+	rplCh := t.client.Subscribe(t.ReplyTopic + "/" + t.id)
+	var statusCh chan []byte
+	if t.StatusTopic != "" {
+		statusCh = t.client.Subscribe(t.StatusTopic)
+	}
 	go func() {
 		for {
 			select {
+			case st, open := <-statusCh:
+				if !open {
+					statusCh = nil
+					continue
+				}
+				t.onStatus(st)
 			case msg, open := <-msgCh:
 				if !open {
 					return
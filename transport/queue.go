@@ -0,0 +1,226 @@
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"time"
+)
+
+var errTimeout = errors.New("timeout waiting for reply from tradfri-mqtt")
+
+type command struct {
+	method   string
+	uri      string
+	payload  []byte
+	attempts int
+	version  int
+}
+
+// isOnline returns false if tradfri-mqtt is believed to be down
+func (t *Transport) isOnline() bool {
+	t.qmu.Lock()
+	defer t.qmu.Unlock()
+	return t.online
+}
+
+func (t *Transport) setOnline(online bool) {
+	t.qmu.Lock()
+	defer t.qmu.Unlock()
+	if t.online == online {
+		return
+	}
+	t.online = online
+	if !online {
+		log.Print("tradfri-mqtt seems to be offline, queueing commands")
+		return
+	}
+	log.Printf("tradfri-mqtt is online, %d queued commands", len(t.queue))
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (t *Transport) onStatus(msg []byte) {
+	switch strings.ToLower(string(msg)) {
+	case "", "0", "false", "offline":
+		t.setOnline(false)
+	default:
+		t.setOnline(true)
+	}
+}
+
+// command sends a put or delete, queueing it for later delivery if
+// tradfri-mqtt is offline or doesn't reply in time. Queued commands that
+// fail are reported to the error callbacks of the tree instead.
+func (t *Transport) command(ctx context.Context, method, uri string, payload []byte) error {
+	t.qmu.Lock()
+	queue := !t.online || len(t.queue) > 0
+	t.qmu.Unlock()
+	if queue {
+		// Sending it now could overtake older queued commands
+		t.enqueue(method, uri, payload)
+		return nil
+	}
+	_, err := t.makeReq(ctx, method, uri, payload)
+	if err == errTimeout {
+		t.enqueue(method, uri, payload)
+		return nil
+	}
+	return err
+}
+
+// enqueue adds a command to the queue, merging it with any queued command
+// for the same uri since the gateway only cares about the final state.
+func (t *Transport) enqueue(method, uri string, payload []byte) {
+	t.qmu.Lock()
+	defer t.qmu.Unlock()
+	log.Printf("Queueing %s to %s", method, uri)
+
+	for _, cmd := range t.queue {
+		if cmd.uri != uri {
+			continue
+		}
+		if cmd.method == method && method == "put" {
+			cmd.payload = mergeJSON(cmd.payload, payload)
+		} else {
+			cmd.method = method
+			cmd.payload = payload
+		}
+		cmd.attempts = 0
+		cmd.version++
+		return
+	}
+	t.queue = append(t.queue, &command{
+		method:  method,
+		uri:     uri,
+		payload: payload,
+	})
+	if !t.draining {
+		t.draining = true
+		go t.drain()
+	}
+}
+
+func (t *Transport) dequeue(cmd *command) {
+	for i, c := range t.queue {
+		if c == cmd {
+			t.queue = append(t.queue[:i], t.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// drain delivers queued commands in order, backing off exponentially
+// while tradfri-mqtt doesn't reply.
+func (t *Transport) drain() {
+	backoff := t.Backoff
+	for {
+		t.qmu.Lock()
+		if len(t.queue) == 0 {
+			t.draining = false
+			t.qmu.Unlock()
+			return
+		}
+		cmd := t.queue[0]
+		method, uri, payload, version := cmd.method, cmd.uri, cmd.payload, cmd.version
+		waitForStatus := !t.online && t.StatusTopic != ""
+		t.qmu.Unlock()
+
+		if waitForStatus {
+			// Wait for tradfri-mqtt to announce itself instead of probing
+			<-t.wake
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		_, err := t.makeReq(ctx, method, uri, payload)
+		cancel()
+
+		t.qmu.Lock()
+		if err != errTimeout {
+			if err != nil {
+				log.Printf("Error sending queued %s to %s: %v", method, uri, err)
+			}
+			if cmd.version == version {
+				t.dequeue(cmd)
+			}
+			backoff = t.Backoff
+			t.qmu.Unlock()
+			if err != nil {
+				t.failed(uri, err)
+			}
+			continue
+		}
+		cmd.attempts++
+		gaveUp := t.Retries >= 0 && cmd.attempts > t.Retries
+		if gaveUp {
+			log.Printf("Giving up on %s to %s after %d attempts", method, uri, cmd.attempts)
+			t.dequeue(cmd)
+		}
+		t.qmu.Unlock()
+		if gaveUp {
+			t.failed(uri, err)
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-t.wake:
+		}
+		if backoff *= 2; backoff > t.MaxBackoff {
+			backoff = t.MaxBackoff
+		}
+	}
+}
+
+// failed reports a queued command that won't be delivered, must be called
+// without the queue locked
+func (t *Transport) failed(uri string, err error) {
+	t.RLock()
+	tree := t.tree
+	t.RUnlock()
+	if tree != nil {
+		tree.ReportError(uri, err)
+	}
+}
+
+// mergeJSON merges the objects in b into a, arrays are merged per index.
+// If either isn't valid JSON b is returned as is.
+func mergeJSON(a, b []byte) []byte {
+	var av, bv interface{}
+	if json.Unmarshal(a, &av) != nil || json.Unmarshal(b, &bv) != nil {
+		return b
+	}
+	js, err := json.Marshal(mergeValue(av, bv))
+	if err != nil {
+		return b
+	}
+	return js
+}
+
+func mergeValue(a, b interface{}) interface{} {
+	switch bv := b.(type) {
+	case map[string]interface{}:
+		av, ok := a.(map[string]interface{})
+		if !ok {
+			return b
+		}
+		for k, v := range bv {
+			av[k] = mergeValue(av[k], v)
+		}
+		return av
+	case []interface{}:
+		av, ok := a.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return b
+		}
+		for i := range bv {
+			av[i] = mergeValue(av[i], bv[i])
+		}
+		return av
+	}
+	return b
+}